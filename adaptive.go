@@ -0,0 +1,160 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultAdaptiveThreshold is used when CacheConfig.AdaptiveThreshold is not set
+const defaultAdaptiveThreshold = 10 * time.Millisecond
+
+// maxFingerprints bounds the number of query fingerprints tracked, later
+// ones are neither timed nor cached adaptively
+const maxFingerprints = 10000
+
+// ewmaWeight is the weight of a new sample in the moving averages
+const ewmaWeight = 0.2
+
+// FingerprintStats describes the queries sharing one fingerprint, the SQL
+// with placeholders
+type FingerprintStats struct {
+	SQL          string        `json:"sql"`
+	Queries      uint64        `json:"queries"`        // executions sent to the database
+	Hits         uint64        `json:"hits"`           // executions served from the cache
+	Latency      time.Duration `json:"latency"`        // moving average of the database latency
+	Bytes        int           `json:"bytes"`          // moving average of the entry size, 0 if never cached
+	Saved        time.Duration `json:"saved"`          // database time saved by hits, Hits * Latency
+	SavedPerByte float64       `json:"saved_per_byte"` // nanoseconds saved per cached byte
+}
+
+// fingerprint is the running measurements of a query fingerprint
+type fingerprint struct {
+	queries uint64
+	hits    uint64
+	latency float64 // nanoseconds
+	bytes   float64
+}
+
+// latencyTracker times the database queries of each fingerprint
+type latencyTracker struct {
+	mu           sync.Mutex
+	fingerprints map[string]*fingerprint
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{fingerprints: make(map[string]*fingerprint)}
+}
+
+// ewma folds sample into avg, the first sample is taken as is
+func ewma(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + ewmaWeight*(sample-avg)
+}
+
+// lookup returns the fingerprint of sql, creating it while under the limit
+func (l *latencyTracker) lookup(sql string) *fingerprint {
+	f, ok := l.fingerprints[sql]
+	if !ok && len(l.fingerprints) < maxFingerprints {
+		f = &fingerprint{}
+		l.fingerprints[sql] = f
+	}
+	return f
+}
+
+// observe records the latency of a database query
+func (l *latencyTracker) observe(sql string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f := l.lookup(sql); f != nil {
+		f.queries++
+		f.latency = ewma(f.latency, float64(d))
+	}
+}
+
+// stored records the size of a cache entry
+func (l *latencyTracker) stored(sql string, size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f := l.lookup(sql); f != nil {
+		f.bytes = ewma(f.bytes, float64(size))
+	}
+}
+
+// hit counts a cache hit
+func (l *latencyTracker) hit(sql string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f := l.lookup(sql); f != nil {
+		f.hits++
+	}
+}
+
+// slow reports whether the average latency of sql reached threshold. An
+// unknown fingerprint is not slow, it is timed first.
+func (l *latencyTracker) slow(sql string, threshold time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.fingerprints[sql]
+	return ok && f.latency >= float64(threshold)
+}
+
+// adaptiveThreshold returns the configured threshold or its default
+func (g *GormCache) adaptiveThreshold() time.Duration {
+	if g.config.AdaptiveThreshold > 0 {
+		return g.config.AdaptiveThreshold
+	}
+	return defaultAdaptiveThreshold
+}
+
+// Fingerprints returns the measurements of every tracked query
+// fingerprint, ranked by database time saved per cached byte. Queries are
+// only tracked when Adaptive is set.
+func (g *GormCache) Fingerprints() []FingerprintStats {
+	g.latency.mu.Lock()
+	stats := make([]FingerprintStats, 0, len(g.latency.fingerprints))
+	for sql, f := range g.latency.fingerprints {
+		s := FingerprintStats{
+			SQL:     sql,
+			Queries: f.queries,
+			Hits:    f.hits,
+			Latency: time.Duration(f.latency),
+			Bytes:   int(f.bytes),
+			Saved:   time.Duration(float64(f.hits) * f.latency),
+		}
+		if f.bytes > 0 {
+			s.SavedPerByte = float64(s.Saved) / f.bytes
+		}
+		stats = append(stats, s)
+	}
+	g.latency.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].SavedPerByte != stats[j].SavedPerByte {
+			return stats[i].SavedPerByte > stats[j].SavedPerByte
+		}
+		if stats[i].Latency != stats[j].Latency {
+			return stats[i].Latency > stats[j].Latency
+		}
+		return stats[i].SQL < stats[j].SQL
+	})
+	return stats
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestAdaptiveCachesSlowQueries(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("adaptive_cache", client, gormcache.CacheConfig{
+		TTL:               time.Minute,
+		Adaptive:          true,
+		AdaptiveThreshold: time.Nanosecond, // every query is slow
+	})
+	require.NoError(t, db.Use(cache))
+
+	// no UseCacheKey in the context
+	find := func() {
+		var users []testUser
+		require.NoError(t, db.Find(&users).Error)
+		assert.Len(t, users, 3)
+	}
+	find() // unknown fingerprint, timed only
+	assert.Equal(t, gormcache.Stats{}, cache.Stats())
+	find() // slow now, cached
+	find()
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+
+	stats := cache.Fingerprints()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "SELECT * FROM `test_users`", stats[0].SQL)
+	assert.Equal(t, uint64(2), stats[0].Queries)
+	assert.Equal(t, uint64(1), stats[0].Hits)
+	assert.Greater(t, stats[0].Latency, time.Duration(0))
+	assert.Greater(t, stats[0].Bytes, 0)
+	assert.Equal(t, stats[0].Latency, stats[0].Saved)
+	assert.Greater(t, stats[0].SavedPerByte, 0.0)
+
+	// an explicit false in the context still opts out
+	ctx := context.WithValue(context.Background(), gormcache.UseCacheKey, false)
+	require.NoError(t, db.Session(&gorm.Session{Context: ctx}).Find(&[]testUser{}).Error)
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+}
+
+func TestAdaptiveSkipsFastQueries(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("adaptive_cache", client, gormcache.CacheConfig{
+		TTL:               time.Minute,
+		Adaptive:          true,
+		AdaptiveThreshold: time.Hour,
+	})
+	require.NoError(t, db.Use(cache))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Find(&[]testUser{}).Error)
+	}
+	assert.Equal(t, gormcache.Stats{}, cache.Stats())
+	assert.Equal(t, 0, client.Len())
+
+	// UseCacheKey still forces caching, and the query is timed as well
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).First(&testUser{}, 1).Error)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+
+	stats := cache.Fingerprints()
+	require.Len(t, stats, 2)
+	assert.Contains(t, stats[0].SQL, "LIMIT", "the cached query saves more per byte")
+	assert.Equal(t, uint64(3), stats[1].Queries)
+	assert.Zero(t, stats[1].Bytes)
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package admin provides an http.Handler to inspect and purge a gormcache
+// cache. It exposes these JSON endpoints, relative to where it is mounted:
+//
+//	GET    /stats             cache counters
+//	GET    /fingerprints      query latencies ranked by time saved per cached byte
+//	GET    /enabled           whether caching is globally enabled
+//	PUT    /enabled           toggle caching, body {"enabled": bool}
+//	GET    /keys/{key}        stored payload and metadata of a key
+//	DELETE /keys/{key}        purge a key
+//	DELETE /prefixes/{prefix} purge every key starting with prefix
+//	DELETE /tables/{table}    purge every query reading table
+//	DELETE /tags/{tag}        purge every entry carrying tag
+//
+// Purges need the matching optional capability of the cache client; when
+// it is missing the endpoint answers 501 Not Implemented. Keys and
+// prefixes outside the cache's CacheConfig.Prefix answer 400 Bad Request.
+//
+// The endpoints can read and delete cached query results, so every
+// request goes through Config.Authorize, and the handler refuses to serve
+// anything without it.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	gormcache "github.com/rgglez/gormcache"
+)
+
+// Config is a struct for handler options
+type Config struct {
+	// Authorize is called before every request; a non-nil error answers
+	// 403 Forbidden with its message. It is required: every request is
+	// refused when nil. A handler mounted behind an authenticating
+	// middleware may allow everything with a func returning nil.
+	Authorize func(r *http.Request) error
+}
+
+// Handler is an http.Handler exposing cache administration endpoints
+type Handler struct {
+	cache  *gormcache.GormCache
+	config Config
+	mux    *http.ServeMux
+}
+
+// NewHandler returns a new Handler instance for cache
+func NewHandler(cache *gormcache.GormCache, config Config) *Handler {
+	h := &Handler{
+		cache:  cache,
+		config: config,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /stats", h.stats)
+	h.mux.HandleFunc("GET /fingerprints", h.fingerprints)
+	h.mux.HandleFunc("GET /enabled", h.enabled)
+	h.mux.HandleFunc("PUT /enabled", h.setEnabled)
+	h.mux.HandleFunc("GET /keys/{key...}", h.lookup)
+	h.mux.HandleFunc("DELETE /keys/{key...}", h.purgeKey)
+	h.mux.HandleFunc("DELETE /prefixes/{prefix...}", h.purgePrefix)
+	h.mux.HandleFunc("DELETE /tables/{table}", h.purgeTable)
+	h.mux.HandleFunc("DELETE /tags/{tag}", h.purgeTag)
+	return h
+}
+
+// ErrNoAuthorize answers every request of a handler without
+// Config.Authorize
+var ErrNoAuthorize = errors.New("admin: no Authorize configured")
+
+// ServeHTTP authorizes and dispatches the request
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.config.Authorize == nil {
+		writeError(w, http.StatusForbidden, ErrNoAuthorize)
+		return
+	}
+	if err := h.config.Authorize(r); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+type enabledBody struct {
+	Enabled bool `json:"enabled"`
+}
+
+type purgedBody struct {
+	Purged int `json:"purged"`
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.cache.Stats())
+}
+
+func (h *Handler) fingerprints(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.cache.Fingerprints())
+}
+
+func (h *Handler) enabled(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, enabledBody{Enabled: h.cache.Enabled()})
+}
+
+func (h *Handler) setEnabled(w http.ResponseWriter, r *http.Request) {
+	var body enabledBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.cache.SetEnabled(body.Enabled)
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (h *Handler) lookup(w http.ResponseWriter, r *http.Request) {
+	info, err := h.cache.Lookup(r.Context(), r.PathValue("key"))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (h *Handler) purgeKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.cache.Purge(r.Context(), r.PathValue("key")); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) purgePrefix(w http.ResponseWriter, r *http.Request) {
+	n, err := h.cache.PurgePrefix(r.Context(), r.PathValue("prefix"))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, purgedBody{Purged: n})
+}
+
+func (h *Handler) purgeTable(w http.ResponseWriter, r *http.Request) {
+	if err := h.cache.PurgeTable(r.Context(), r.PathValue("table")); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) purgeTag(w http.ResponseWriter, r *http.Request) {
+	if err := h.cache.PurgeTags(r.Context(), r.PathValue("tag")); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusOf maps cache errors to HTTP status codes
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, gormcache.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, gormcache.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, gormcache.ErrOutOfScope):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
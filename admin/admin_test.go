@@ -0,0 +1,169 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/rgglez/gormcache/admin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type adminUser struct {
+	ID   int
+	Name string
+}
+
+// allowAll authorizes every request, as behind an authenticating proxy
+var allowAll = admin.Config{Authorize: func(*http.Request) error { return nil }}
+
+func newAdmin(t *testing.T, config admin.Config) (*gorm.DB, *gormcache.MemoryClient, *gormcache.GormCache, http.Handler) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	require.NoError(t, db.AutoMigrate(&adminUser{}))
+	require.NoError(t, db.Create(&adminUser{ID: 1, Name: "one"}).Error)
+
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("admin_cache", client, gormcache.CacheConfig{TTL: time.Minute, Prefix: "c:"})
+	require.NoError(t, db.Use(cache))
+	return db, client, cache, admin.NewHandler(cache, config)
+}
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func cached(db *gorm.DB) {
+	ctx := context.WithValue(context.Background(), gormcache.UseCacheKey, true)
+	db.Session(&gorm.Session{Context: ctx}).Find(&[]adminUser{})
+}
+
+func TestAdminStatsAndLookup(t *testing.T) {
+	db, client, _, h := newAdmin(t, allowAll)
+	cached(db)
+	cached(db)
+
+	rec := do(h, http.MethodGet, "/stats", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats gormcache.Stats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, stats)
+
+	rec = do(h, http.MethodGet, "/fingerprints", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String(), "queries are only timed in adaptive mode")
+
+	keys, _ := client.Keys(context.Background(), "c:")
+	require.Len(t, keys, 1)
+	key := keys[0]
+	rec = do(h, http.MethodGet, "/keys/"+key, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var info gormcache.EntryInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, key, info.Key)
+	assert.True(t, info.HasTTL)
+	assert.Greater(t, info.Size, 0)
+	assert.JSONEq(t, `[{"ID":1,"Name":"one"}]`, string(info.Value))
+
+	assert.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/keys/c:missing", "").Code)
+}
+
+func TestAdminPurge(t *testing.T) {
+	db, client, _, h := newAdmin(t, allowAll)
+
+	cached(db)
+	assert.Equal(t, http.StatusNoContent, do(h, http.MethodDelete, "/tables/admin_users", "").Code)
+	assert.Equal(t, 0, client.Len())
+
+	cached(db)
+	rec := do(h, http.MethodDelete, "/prefixes/c:", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"purged":1}`, rec.Body.String())
+}
+
+func TestAdminToggle(t *testing.T) {
+	db, client, cache, h := newAdmin(t, allowAll)
+
+	rec := do(h, http.MethodPut, "/enabled", `{"enabled":false}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, cache.Enabled())
+	cached(db)
+	assert.Equal(t, 0, client.Len())
+
+	assert.JSONEq(t, `{"enabled":false}`, do(h, http.MethodGet, "/enabled", "").Body.String())
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodPut, "/enabled", "nope").Code)
+}
+
+func TestAdminAuthorize(t *testing.T) {
+	_, _, _, h := newAdmin(t, admin.Config{
+		Authorize: func(r *http.Request) error {
+			if r.Header.Get("X-Token") != "secret" {
+				return errors.New("bad token")
+			}
+			return nil
+		},
+	})
+
+	rec := do(h, http.MethodGet, "/stats", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.JSONEq(t, `{"error":"bad token"}`, rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("X-Token", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAdminRequiresAuthorize(t *testing.T) {
+	_, _, _, h := newAdmin(t, admin.Config{})
+	rec := do(h, http.MethodGet, "/stats", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.JSONEq(t, `{"error":"admin: no Authorize configured"}`, rec.Body.String())
+}
+
+func TestAdminScope(t *testing.T) {
+	db, client, _, h := newAdmin(t, allowAll)
+	cached(db)
+	ctx := context.Background()
+	require.NoError(t, client.Set(ctx, "other:app", []byte("1"), 0))
+
+	// keys of other applications sharing the backend are out of reach
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodGet, "/keys/other:app", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodDelete, "/keys/other:app", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodDelete, "/prefixes/other:", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodDelete, "/prefixes/", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodDelete, "/prefixes/c", "").Code)
+	assert.Equal(t, 2, client.Len())
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import "log"
+
+// tooManyRows reports whether a result of rows rows exceeds MaxRows. It is
+// checked before encoding, the row count comes from the scan.
+func (g *GormCache) tooManyRows(key string, rows int64) bool {
+	if g.config.MaxRows <= 0 || rows <= g.config.MaxRows {
+		return false
+	}
+	g.counters.skips.Add(1)
+	log.Printf("*** skip cache, key: %v, %d rows over limit %d", key, rows, g.config.MaxRows)
+	return true
+}
+
+// tooLarge reports whether an encoded entry exceeds MaxEntryBytes
+func (g *GormCache) tooLarge(key string, payload []byte) bool {
+	if g.config.MaxEntryBytes <= 0 || len(payload) <= g.config.MaxEntryBytes {
+		return false
+	}
+	g.counters.skips.Add(1)
+	log.Printf("*** skip cache, key: %v, %d bytes over limit %d", key, len(payload), g.config.MaxEntryBytes)
+	return true
+}
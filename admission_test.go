@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestMaxRows(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("rows_cache", client, gormcache.CacheConfig{TTL: time.Minute, MaxRows: 2})
+	require.NoError(t, db.Use(cache))
+
+	assert.Len(t, findUsers(t, db), 3)
+	assert.Len(t, findUsers(t, db), 3)
+	var users []testUser
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Where("id <= ?", 2).Find(&users).Error)
+	assert.Len(t, users, 2)
+
+	assert.Equal(t, gormcache.Stats{Misses: 3, Sets: 1, Skips: 2}, cache.Stats())
+	assert.Equal(t, 1, client.Len())
+}
+
+func TestMaxEntryBytes(t *testing.T) {
+	for _, envelope := range []bool{false, true} {
+		db := newTestDB(t, 20)
+		client := gormcache.NewMemoryClient()
+		cache := gormcache.NewGormCache("bytes_cache", client, gormcache.CacheConfig{TTL: time.Minute, MaxEntryBytes: 200, Envelope: envelope})
+		require.NoError(t, db.Use(cache))
+
+		assert.Len(t, findUsers(t, db), 20)
+		var user testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).First(&user, 1).Error)
+
+		assert.Equal(t, gormcache.Stats{Misses: 2, Sets: 1, Skips: 1}, cache.Stats())
+		assert.Equal(t, 1, client.Len())
+	}
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+var aggregateCases = []e2eCase{
+	{"count", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var count int64
+		return &count, db.Model(&testUser{}).Count(&count)
+	}},
+	{"count where", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var count int64
+		return &count, db.Model(&testUser{}).Where("name = ?", "user5").Count(&count)
+	}},
+	{"count group", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var count int64
+		return &count, db.Model(&testUser{}).Group("name").Count(&count)
+	}},
+	{"count group none", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var count int64
+		return &count, db.Model(&testUser{}).Where("id > ?", 100).Group("name").Count(&count)
+	}},
+	{"count distinct", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var count int64
+		return &count, db.Model(&testUser{}).Distinct("name").Count(&count)
+	}},
+	{"sum find", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var sum int64
+		return &sum, db.Model(&testUser{}).Select("SUM(id)").Find(&sum)
+	}},
+	{"sum scan", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var sum int64
+		return &sum, db.Model(&testUser{}).Select("SUM(id)").Scan(&sum)
+	}},
+	{"max name", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var name string
+		return &name, db.Model(&testUser{}).Select("MAX(name)").Scan(&name)
+	}},
+	{"avg", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var avg float64
+		return &avg, db.Model(&testUser{}).Select("AVG(id)").Find(&avg)
+	}},
+	{"pluck", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var names []string
+		return &names, db.Model(&testUser{}).Order("id").Pluck("name", &names)
+	}},
+	{"pluck distinct", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var names []string
+		return &names, db.Model(&testUser{}).Distinct().Order("name").Pluck("name", &names)
+	}},
+}
+
+// newAggregateDB returns a database with six users, two of them sharing a name
+func newAggregateDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := newTestDB(t, 5)
+	require.NoError(t, db.Create(&testUser{ID: 6, Name: "user5"}).Error)
+	return db
+}
+
+func TestAggregates(t *testing.T) {
+	configs := map[string]gormcache.CacheConfig{
+		"plain":    {TTL: time.Minute},
+		"envelope": {TTL: time.Minute, Envelope: true},
+		"columns":  {TTL: time.Minute, Columns: true},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			db := newAggregateDB(t)
+			cache := gormcache.NewGormCache("aggregate_cache", gormcache.NewMemoryClient(), config)
+			require.NoError(t, db.Use(cache))
+
+			for _, c := range aggregateCases {
+				want, tx := c.run(db)
+				wantRows := tx.RowsAffected
+				require.NoError(t, tx.Error, c.name)
+
+				for _, pass := range []string{"miss", "hit"} {
+					got, tx := c.run(db.Session(&gorm.Session{Context: cacheCtx()}))
+					require.NoError(t, tx.Error, "%s %s", c.name, pass)
+					assert.Equal(t, want, got, "%s %s", c.name, pass)
+					assert.Equal(t, wantRows, tx.RowsAffected, "%s %s rows", c.name, pass)
+				}
+			}
+			stats := cache.Stats()
+			assert.Zero(t, stats.Errors)
+			assert.Equal(t, uint64(len(aggregateCases)), stats.Hits)
+		})
+	}
+}
+
+// TestCountCompact checks that a count is stored as its bare value, and a
+// grouped count, which reports the number of groups, as columns
+func TestCountCompact(t *testing.T) {
+	db := newAggregateDB(t)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("aggregate_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	var count int64
+	require.NoError(t, db.WithContext(cacheCtx()).Model(&testUser{}).Count(&count).Error)
+	info, err := cache.Lookup(context.Background(), onlyKey(t, client))
+	require.NoError(t, err)
+	assert.JSONEq(t, "6", string(info.Value))
+	assert.False(t, info.Columns)
+
+	require.NoError(t, cache.PurgeTable(context.Background(), "test_users"))
+	require.NoError(t, db.WithContext(cacheCtx()).Model(&testUser{}).Group("name").Count(&count).Error)
+	info, err = cache.Lookup(context.Background(), onlyKey(t, client))
+	require.NoError(t, err)
+	assert.True(t, info.Columns)
+}
+
+func TestCountOptions(t *testing.T) {
+	db := newAggregateDB(t)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("aggregate_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	count := func(ctx context.Context) (n int64) {
+		require.NoError(t, db.WithContext(ctx).Model(&testUser{}).Count(&n).Error)
+		return n
+	}
+
+	// no context value, no cache
+	assert.Equal(t, int64(6), count(context.Background()))
+	assert.Zero(t, cache.Stats().Sets)
+
+	// custom ttl
+	ctx := context.WithValue(cacheCtx(), gormcache.CacheTTLKey, 5*time.Second)
+	assert.Equal(t, int64(6), count(ctx))
+	info, err := cache.Lookup(context.Background(), onlyKey(t, client))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.TTL, 5*time.Second)
+
+	// tagged with the table
+	require.NoError(t, db.Create(&testUser{ID: 7, Name: "user7"}).Error)
+	assert.Equal(t, int64(6), count(ctx))
+	require.NoError(t, cache.PurgeTable(context.Background(), "test_users"))
+	assert.Equal(t, int64(7), count(ctx))
+}
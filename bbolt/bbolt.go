@@ -17,9 +17,11 @@
 package gormcachebbolt
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"log"
+	"strconv"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -55,14 +57,37 @@ func (r *BboltClient) Get(ctx context.Context, key string) (interface{}, error)
 	return data, nil
 }
 
-// Set sets value to bbolt by key with ttl using json encoding/decoding
-func (r *BboltClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
-	data, err := json.Marshal(value) // encode value to json bytes using json encoding/decoding
+// GetMulti gets the values of keys from bbolt in one read transaction,
+// nil for missing keys
+func (r *BboltClient) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	values := make([]interface{}, len(keys))
+	err := r.client.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("DB"))
+		for i, key := range keys {
+			if data := bucket.Get([]byte(key)); len(data) > 0 {
+				values[i] = append([]byte(nil), data...) // only valid inside the transaction
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = r.client.Update(func(tx *bolt.Tx) error {
-		err = tx.Bucket([]byte("DB")).Put([]byte(key), data)
+	return values, nil
+}
+
+// Set sets value to bbolt by key with ttl, []byte values as they are and
+// anything else using json encoding
+func (r *BboltClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, ok := value.([]byte) // encoded entries are stored verbatim
+	if !ok {
+		var err error
+		if data, err = json.Marshal(value); err != nil { // encode value to json bytes using json encoding/decoding
+			return err
+		}
+	}
+	err := r.client.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte("DB")).Put([]byte(key), data)
 		if err != nil {
 			return err
 		}
@@ -70,3 +95,58 @@ func (r *BboltClient) Set(ctx context.Context, key string, value interface{}, tt
 	})
 	return err
 }
+
+// Incr atomically increments the counter stored at key
+func (r *BboltClient) Incr(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := r.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("DB"))
+		if data := bucket.Get([]byte(key)); len(data) > 0 {
+			var err error
+			if n, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+				return err
+			}
+		}
+		n++
+		return bucket.Put([]byte(key), []byte(strconv.FormatInt(n, 10)))
+	})
+	return n, err
+}
+
+// Delete deletes keys from bbolt
+func (r *BboltClient) Delete(ctx context.Context, keys ...string) error {
+	return r.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("DB"))
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Keys lists the keys starting with prefix
+func (r *BboltClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := r.client.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("DB")).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Flush deletes every key by recreating the bucket
+func (r *BboltClient) Flush(ctx context.Context) error {
+	return r.client.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("DB")); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte("DB"))
+		return err
+	})
+}
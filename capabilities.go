@@ -0,0 +1,88 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Optional capabilities a CacheClient may implement. Features built on
+// them check for the interface and fail with an error when it is missing.
+
+// Incrementer is implemented by cache clients that support atomic counters.
+// Counters are stored as decimal strings, so Get returns them as []byte.
+type Incrementer interface {
+	Incr(ctx context.Context, key string) (int64, error)
+}
+
+// Deleter is implemented by cache clients that can delete keys
+type Deleter interface {
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Tagger is implemented by cache clients that can associate keys with tags
+// and delete every key carrying a tag
+type Tagger interface {
+	Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error
+	DeleteTags(ctx context.Context, tags ...string) error
+}
+
+// Flusher is implemented by cache clients that can drop every entry
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// ErrNotSupported is returned when an operation needs a capability the
+// cache client does not implement
+var ErrNotSupported = errors.New("gormcache: operation not supported by cache client")
+
+// TTLReader is implemented by cache clients that can tell the remaining
+// time to live of a key: 0 when it never expires, and found is false when
+// the key does not exist
+type TTLReader interface {
+	TTL(ctx context.Context, key string) (ttl time.Duration, found bool, err error)
+}
+
+// KeyLister is implemented by cache clients that can list keys by prefix
+type KeyLister interface {
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// MultiGetter is implemented by cache clients that can read many keys in
+// one round trip. Values are returned in key order, nil for missing keys.
+type MultiGetter interface {
+	GetMulti(ctx context.Context, keys []string) ([]interface{}, error)
+}
+
+// getMulti reads keys with one GetMulti when the client supports it, one
+// Get per key otherwise
+func getMulti(ctx context.Context, client CacheClient, keys []string) ([]interface{}, error) {
+	if multi, ok := client.(MultiGetter); ok {
+		return multi.GetMulti(ctx, keys)
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		value, err := client.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	memcache "github.com/bradfitz/gomemcache/memcache"
+	redis "github.com/redis/go-redis/v9"
+	gormcache "github.com/rgglez/gormcache"
+	gormcachebbolt "github.com/rgglez/gormcache/bbolt"
+	gormcachememcached "github.com/rgglez/gormcache/memcached"
+	gormcacheredis "github.com/rgglez/gormcache/redis"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltTimeout is how long to wait for the lock of a bolt file held by
+// another process
+const boltTimeout = 2 * time.Second
+
+// nopCloser closes nothing
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// dial connects to the backend described by rawURL:
+//
+//	redis://[:password@]host:port[/db]
+//	memcached://host:port[,host:port...]
+//	bolt:///path/to/file.db
+//
+// A bolt file is opened read-only unless write is true.
+func dial(rawURL string, write bool) (gormcache.CacheClient, io.Closer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		opts, err := redis.ParseURL(rawURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		rdb := redis.NewClient(opts)
+		return gormcacheredis.NewTaggedRedisClient(rdb), rdb, nil // purge-table and purge-tag read the tag sets
+	case "memcached":
+		if u.Host == "" {
+			return nil, nil, fmt.Errorf("missing memcached host in %q", rawURL)
+		}
+		mdb := memcache.New(strings.Split(u.Host, ",")...)
+		return gormcachememcached.NewMemcacheClient(mdb), nopCloser{}, nil
+	case "bolt", "bbolt":
+		if u.Path == "" {
+			return nil, nil, fmt.Errorf("missing bolt file path in %q", rawURL)
+		}
+		bdb, err := bolt.Open(u.Path, 0600, &bolt.Options{Timeout: boltTimeout, ReadOnly: !write})
+		if err != nil {
+			return nil, nil, err
+		}
+		err = bdb.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("DB")) == nil {
+				return fmt.Errorf("bolt file %v has no DB bucket", u.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			bdb.Close()
+			return nil, nil, err
+		}
+		return gormcachebbolt.NewBboltClient(bdb), bdb, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+}
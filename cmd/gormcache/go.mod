@@ -0,0 +1,36 @@
+module github.com/rgglez/gormcache/cmd/gormcache
+
+go 1.25.9
+
+require (
+	github.com/bradfitz/gomemcache v0.0.0-20260422231931-4d751bb6e37c
+	github.com/redis/go-redis/v9 v9.18.0
+	github.com/rgglez/gormcache v0.0.16
+	github.com/rgglez/gormcache/bbolt v0.1.0
+	github.com/rgglez/gormcache/memcached v0.1.0
+	github.com/rgglez/gormcache/redis v0.1.0
+	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.4.3
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.43.0 // indirect
+	golang.org/x/text v0.36.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	gorm.io/gorm v1.31.1 // indirect
+)
+
+// the CLI is built from this repository against the plugins next to it
+replace (
+	github.com/rgglez/gormcache => ../..
+	github.com/rgglez/gormcache/bbolt => ../../bbolt
+	github.com/rgglez/gormcache/memcached => ../../memcached
+	github.com/rgglez/gormcache/redis => ../../redis
+)
@@ -0,0 +1,241 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Command gormcache inspects and maintains a gormcache backend.
+//
+// Usage:
+//
+//	gormcache [-url URL] [-prefix PREFIX] [-generations] COMMAND [ARGS]
+//
+// The backend URL defaults to $GORMCACHE_URL. Commands:
+//
+//	keys [PREFIX]          list keys, by default those under -prefix
+//	get KEY                show size, TTL and the pretty-printed payload of a key
+//	ttl KEY                show the remaining TTL of a key
+//	stats [PREFIX]         count the keys and bytes under a prefix
+//	purge KEY...           delete keys
+//	purge-prefix PREFIX    delete every key starting with PREFIX
+//	purge-table TABLE...   drop every query reading a table
+//	purge-tag TAG...       delete every entry carrying a tag
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+)
+
+// writeCommands are the commands that modify the backend
+var writeCommands = map[string]bool{
+	"purge":        true,
+	"purge-prefix": true,
+	"purge-table":  true,
+	"purge-tag":    true,
+}
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line args and returns the exit code
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("gormcache", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rawURL := flags.String("url", os.Getenv("GORMCACHE_URL"), "backend URL: redis://host:port/db, memcached://host:port or bolt:///path")
+	prefix := flags.String("prefix", "", "cache key prefix, as in CacheConfig.Prefix")
+	generations := flags.Bool("generations", false, "the cache uses table generations, as in CacheConfig.Generations")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || *rawURL == "" {
+		fmt.Fprintln(stderr, "usage: gormcache -url URL COMMAND [ARGS]")
+		flags.PrintDefaults()
+		return 2
+	}
+	command, params := flags.Arg(0), flags.Args()[1:]
+
+	client, closer, err := dial(*rawURL, writeCommands[command])
+	if err != nil {
+		fmt.Fprintln(stderr, "gormcache:", err)
+		return 1
+	}
+	defer closer.Close()
+
+	cli := &cli{
+		cache: gormcache.NewGormCache("gormcache-cli", client, gormcache.CacheConfig{
+			Prefix:      *prefix,
+			Generations: *generations,
+		}),
+		client: client,
+		prefix: *prefix,
+		out:    stdout,
+	}
+	if err = cli.exec(ctx, command, params); err != nil {
+		fmt.Fprintln(stderr, "gormcache:", err)
+		return 1
+	}
+	return 0
+}
+
+// cli runs the commands against one backend
+type cli struct {
+	cache  *gormcache.GormCache
+	client gormcache.CacheClient
+	prefix string
+	out    io.Writer
+}
+
+var errUsage = errors.New("wrong number of arguments")
+
+func (c *cli) exec(ctx context.Context, command string, params []string) error {
+	switch command {
+	case "keys":
+		return c.keys(ctx, c.prefixArg(params))
+	case "get":
+		if len(params) != 1 {
+			return errUsage
+		}
+		return c.get(ctx, params[0])
+	case "ttl":
+		if len(params) != 1 {
+			return errUsage
+		}
+		return c.ttl(ctx, params[0])
+	case "stats":
+		return c.stats(ctx, c.prefixArg(params))
+	case "purge":
+		if len(params) == 0 {
+			return errUsage
+		}
+		return c.cache.Purge(ctx, params...)
+	case "purge-prefix":
+		if len(params) != 1 {
+			return errUsage
+		}
+		n, err := c.cache.PurgePrefix(ctx, params[0])
+		if err == nil {
+			fmt.Fprintf(c.out, "purged %d keys\n", n)
+		}
+		return err
+	case "purge-table":
+		for _, table := range params {
+			if err := c.cache.PurgeTable(ctx, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "purge-tag":
+		return c.cache.PurgeTags(ctx, params...)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func (c *cli) prefixArg(params []string) string {
+	if len(params) > 0 {
+		return params[0]
+	}
+	return c.prefix
+}
+
+func (c *cli) lister() (gormcache.KeyLister, error) {
+	lister, ok := c.client.(gormcache.KeyLister)
+	if !ok {
+		return nil, fmt.Errorf("%w: KeyLister", gormcache.ErrNotSupported)
+	}
+	return lister, nil
+}
+
+func (c *cli) keys(ctx context.Context, prefix string) error {
+	lister, err := c.lister()
+	if err != nil {
+		return err
+	}
+	keys, err := lister.Keys(ctx, prefix)
+	for _, key := range keys {
+		fmt.Fprintln(c.out, key)
+	}
+	return err
+}
+
+func (c *cli) get(ctx context.Context, key string) error {
+	info, err := c.cache.Lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "key:  %s\nsize: %d bytes\nttl:  %s\n", info.Key, info.Size, formatTTL(info))
+	if meta := info.Meta; meta != nil {
+		fmt.Fprintf(c.out, "sql:  %s\ntables: %s\ncreated: %s\nrows: %d\ntype: %s\n",
+			meta.SQL, strings.Join(meta.Tables, ", "), meta.CreatedAt.Format(time.RFC3339), meta.Rows, meta.Type)
+	}
+
+	var pretty bytes.Buffer
+	if err = json.Indent(&pretty, info.Value, "", "  "); err != nil {
+		pretty.Write(info.Value)
+	}
+	fmt.Fprintln(c.out, pretty.String())
+	return nil
+}
+
+func (c *cli) ttl(ctx context.Context, key string) error {
+	info, err := c.cache.Lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, formatTTL(info))
+	return nil
+}
+
+func (c *cli) stats(ctx context.Context, prefix string) error {
+	lister, err := c.lister()
+	if err != nil {
+		return err
+	}
+	keys, err := lister.Keys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	size := 0
+	for _, key := range keys {
+		value, err := c.client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if data, ok := value.([]byte); ok {
+			size += len(data)
+		}
+	}
+	fmt.Fprintf(c.out, "prefix: %q\nkeys:   %d\nbytes:  %d\n", prefix, len(keys), size)
+	return nil
+}
+
+func formatTTL(info *gormcache.EntryInfo) string {
+	switch {
+	case !info.HasTTL:
+		return "unknown"
+	case info.TTL == 0:
+		return "none"
+	}
+	return info.TTL.String()
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newBoltFile creates a bolt cache file holding entries
+func newBoltFile(t *testing.T, entries map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	bdb, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	defer bdb.Close()
+	require.NoError(t, bdb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("DB"))
+		if err != nil {
+			return err
+		}
+		for k, v := range entries {
+			if err = bucket.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return "bolt://" + path
+}
+
+func runCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLIBolt(t *testing.T) {
+	url := newBoltFile(t, map[string]string{
+		"cache:a": `[{"ID":1}]`,
+		"cache:b": `{"ID":2}`,
+		"other:c": `3`,
+		"meta:d":  `{"_gormcache":{"sql":"SELECT * FROM users","tables":["users"],"created_at":"2024-01-02T03:04:05Z","ttl":60000000000,"rows":1,"type":"*[]main.User"},"data":[{"ID":4}]}`,
+	})
+
+	// the default prefix is CacheConfig.Prefix's, every key
+	code, out, _ := runCLI("-url", url, "keys")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "cache:a\ncache:b\nmeta:d\nother:c\n", out)
+	code, out, _ = runCLI("-url", url, "-prefix", "cache:", "keys")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "cache:a\ncache:b\n", out)
+
+	code, out, _ = runCLI("-url", url, "get", "cache:a")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "size: 10 bytes")
+	assert.Contains(t, out, "ttl:  unknown")
+	assert.Contains(t, out, "[\n  {\n    \"ID\": 1\n  }\n]")
+
+	code, _, errOut := runCLI("-url", url, "-prefix", "cache:", "get", "meta:d")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, errOut, "outside the cache prefix")
+
+	code, out, _ = runCLI("-url", url, "get", "meta:d")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "sql:  SELECT * FROM users\ntables: users\ncreated: 2024-01-02T03:04:05Z\nrows: 1\ntype: *[]main.User\n")
+	assert.Contains(t, out, "\"ID\": 4")
+
+	code, out, _ = runCLI("-url", url, "stats", "other:")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "keys:   1")
+	assert.Contains(t, out, "bytes:  1")
+
+	code, out, _ = runCLI("-url", url, "purge-prefix", "cache:")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "purged 2 keys\n", out)
+
+	code, _, errOut = runCLI("-url", url, "get", "cache:a")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, errOut, "key not found")
+
+	code, _, _ = runCLI("-url", url, "purge", "other:c", "meta:d")
+	assert.Equal(t, 0, code)
+	_, out, _ = runCLI("-url", url, "keys", "")
+	assert.Empty(t, out)
+}
+
+func TestCLIErrors(t *testing.T) {
+	url := newBoltFile(t, nil)
+
+	code, _, errOut := runCLI("-url", url, "purge-tag", "report")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, errOut, "not supported")
+
+	code, _, errOut = runCLI("-url", url, "frobnicate")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, errOut, `unknown command "frobnicate"`)
+
+	code, _, _ = runCLI("-url", url, "get")
+	assert.Equal(t, 1, code)
+
+	code, _, errOut = runCLI("-url", "ftp://host", "keys")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, errOut, `unsupported backend scheme "ftp"`)
+
+	code, _, _ = runCLI("keys")
+	assert.Equal(t, 2, code)
+}
@@ -0,0 +1,368 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// columnsKey is the gorm instance setting holding the result set a query
+// was scanned from
+const columnsKey = "gormcache:columns"
+
+// resultSet is the raw result of a query: its columns and the driver
+// values of every row. Replaying it through database/sql and gorm.Scan
+// fills any destination exactly like the database did.
+type resultSet struct {
+	Columns []resultColumn  `json:"columns"`
+	Rows    [][]columnValue `json:"rows"`
+}
+
+// resultColumn describes a column of a result set
+type resultColumn struct {
+	Name     string `json:"name"`
+	DBType   string `json:"db_type,omitempty"`
+	ScanType string `json:"scan_type,omitempty"`
+}
+
+// columnValue is a driver value encoded with its type, as a [tag, data]
+// pair
+type columnValue struct {
+	v driver.Value
+}
+
+// encodedTime keeps the instant and the location of a time.Time
+type encodedTime struct {
+	Sec    int64  `json:"s"`
+	Nsec   int    `json:"n"`
+	Zone   string `json:"z"`
+	Offset int    `json:"o"`
+}
+
+// ErrUnsupportedValue is returned when a driver value of a column cannot
+// be stored with Columns
+var ErrUnsupportedValue = errors.New("gormcache: unsupported column value")
+
+// MarshalJSON encodes the value with a type tag
+func (c columnValue) MarshalJSON() ([]byte, error) {
+	var pair [2]interface{}
+	switch v := c.v.(type) {
+	case nil:
+		pair = [2]interface{}{"n", nil}
+	case int64:
+		pair = [2]interface{}{"i", strconv.FormatInt(v, 10)}
+	case uint64:
+		pair = [2]interface{}{"u", strconv.FormatUint(v, 10)}
+	case float64:
+		pair = [2]interface{}{"f", strconv.FormatFloat(v, 'g', -1, 64)}
+	case bool:
+		pair = [2]interface{}{"b", v}
+	case string:
+		if utf8.ValidString(v) {
+			pair = [2]interface{}{"s", v}
+		} else {
+			pair = [2]interface{}{"S", base64.StdEncoding.EncodeToString([]byte(v))}
+		}
+	case []byte:
+		pair = [2]interface{}{"x", v}
+	case time.Time:
+		_, offset := v.Zone()
+		pair = [2]interface{}{"t", encodedTime{Sec: v.Unix(), Nsec: v.Nanosecond(), Zone: v.Location().String(), Offset: offset}}
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedValue, c.v)
+	}
+	return json.Marshal(pair)
+}
+
+// UnmarshalJSON decodes a value encoded by MarshalJSON
+func (c *columnValue) UnmarshalJSON(data []byte) error {
+	var pair [2]json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	var tag, s string
+	if err := json.Unmarshal(pair[0], &tag); err != nil {
+		return err
+	}
+	var err error
+	switch tag {
+	case "n":
+		c.v = nil
+	case "i", "u", "f":
+		if err = json.Unmarshal(pair[1], &s); err != nil {
+			return err
+		}
+		switch tag {
+		case "i":
+			c.v, err = strconv.ParseInt(s, 10, 64)
+		case "u":
+			c.v, err = strconv.ParseUint(s, 10, 64)
+		default:
+			c.v, err = strconv.ParseFloat(s, 64)
+		}
+	case "b":
+		var b bool
+		err = json.Unmarshal(pair[1], &b)
+		c.v = b
+	case "s":
+		err = json.Unmarshal(pair[1], &s)
+		c.v = s
+	case "S":
+		var b []byte
+		err = json.Unmarshal(pair[1], &b)
+		c.v = string(b)
+	case "x":
+		b := []byte{} // an empty column is not NULL
+		err = json.Unmarshal(pair[1], &b)
+		c.v = b
+	case "t":
+		var t encodedTime
+		if err = json.Unmarshal(pair[1], &t); err == nil {
+			c.v = time.Unix(t.Sec, int64(t.Nsec)).In(location(t.Zone, t.Offset, t.Sec))
+		}
+	default:
+		err = fmt.Errorf("%w: tag %q", ErrUnsupportedValue, tag)
+	}
+	return err
+}
+
+// location returns the location named zone, checking that it has offset
+// at the given instant, or a fixed zone with that name and offset
+func location(zone string, offset int, sec int64) *time.Location {
+	switch zone {
+	case "UTC":
+		return time.UTC
+	case "Local":
+		if _, o := time.Unix(sec, 0).In(time.Local).Zone(); o == offset {
+			return time.Local
+		}
+	default:
+		if loc := loadLocation(zone); loc != nil {
+			if _, o := time.Unix(sec, 0).In(loc).Zone(); o == offset {
+				return loc
+			}
+		}
+	}
+	return time.FixedZone(zone, offset)
+}
+
+// locations memoizes loadLocation, a nil location records an unknown zone
+var locations sync.Map // string -> *time.Location
+
+// loadLocation returns the location named zone, loading it once, or nil
+// when there is no such zone
+func loadLocation(zone string) *time.Location {
+	if loc, ok := locations.Load(zone); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil || zone == "" {
+		loc = nil
+	}
+	locations.Store(zone, loc)
+	return loc
+}
+
+// scanTypes maps the names of column scan types back to the types. It
+// knows the common ones and learns every type it records, so entries
+// written by another process may fall back to interface{}.
+var scanTypes sync.Map // string -> reflect.Type
+
+func init() {
+	for _, v := range []interface{}{
+		int64(0), int32(0), int16(0), int8(0), uint64(0), uint32(0), uint16(0), uint8(0),
+		float64(0), float32(0), "", []byte(nil), false, time.Time{}, sql.RawBytes(nil),
+		sql.NullInt64{}, sql.NullInt32{}, sql.NullInt16{}, sql.NullByte{}, sql.NullFloat64{},
+		sql.NullString{}, sql.NullBool{}, sql.NullTime{}, new(interface{}),
+	} {
+		t := reflect.TypeOf(v)
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		scanTypes.Store(t.String(), t)
+	}
+}
+
+// readResultSet reads every remaining row of rows as driver values
+func readResultSet(rows *sql.Rows) (*resultSet, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	rs := &resultSet{Columns: make([]resultColumn, len(types))}
+	for i, ct := range types {
+		rs.Columns[i] = resultColumn{Name: ct.Name(), DBType: ct.DatabaseTypeName()}
+		if t := ct.ScanType(); t != nil {
+			rs.Columns[i].ScanType = t.String()
+			scanTypes.LoadOrStore(t.String(), t)
+		}
+	}
+
+	holders := make([]interface{}, len(types))
+	for rows.Next() {
+		raw := make([]interface{}, len(types))
+		for i := range raw {
+			holders[i] = &raw[i]
+		}
+		if err = rows.Scan(holders...); err != nil {
+			return nil, err
+		}
+		row := make([]columnValue, len(raw))
+		for i, v := range raw {
+			row[i] = columnValue{v}
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+	return rs, rows.Err()
+}
+
+// replay scans rs into the destination of db with gorm.Scan, through a
+// database/sql driver serving the recorded values
+func replay(db *gorm.DB, rs *resultSet) {
+	rows, err := replayPool().QueryContext(context.WithoutCancel(db.Statement.Context), "", rs)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	defer func() {
+		db.AddError(rows.Close())
+	}()
+	gorm.Scan(rows, db, 0)
+}
+
+// encodeColumns encodes a result set in a version 2 envelope
+func (g *GormCache) encodeColumns(meta *EntryMeta, rs *resultSet, ttl time.Duration) ([]byte, error) {
+	payload, err := json.Marshal(rs)
+	if err != nil {
+		return nil, err
+	}
+	return sealEnvelope(2, JSONSerializer{}.ID(), flagColumns, payload, g.config.CompressThreshold, meta, ttl)
+}
+
+// decodeColumns decodes the result set of a column entry
+func decodeColumns(entry *storedEntry) (*resultSet, error) {
+	rs := &resultSet{}
+	if err := json.Unmarshal(entry.Payload, rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+var (
+	replayOnce sync.Once
+	replayDB   *sql.DB
+)
+
+// replayPool returns the database/sql handle of the replay driver
+func replayPool() *sql.DB {
+	replayOnce.Do(func() {
+		replayDB = sql.OpenDB(replayConnector{})
+	})
+	return replayDB
+}
+
+// replayConnector, replayConn and replayRows implement a database/sql
+// driver whose queries take a *resultSet as their only argument and
+// return its rows, or an error and fail with it
+type replayConnector struct{}
+
+func (replayConnector) Connect(context.Context) (driver.Conn, error) { return replayConn{}, nil }
+
+func (replayConnector) Driver() driver.Driver { return replayDriver{} }
+
+type replayDriver struct{}
+
+func (replayDriver) Open(string) (driver.Conn, error) { return replayConn{}, nil }
+
+var errReplayOnly = errors.New("gormcache: the replay driver only serves recorded results")
+
+type replayConn struct{}
+
+func (replayConn) Prepare(string) (driver.Stmt, error) { return nil, errReplayOnly }
+
+func (replayConn) Close() error { return nil }
+
+func (replayConn) Begin() (driver.Tx, error) { return nil, errReplayOnly }
+
+// CheckNamedValue lets the *resultSet argument through unconverted
+func (replayConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (replayConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) != 1 {
+		return nil, errReplayOnly
+	}
+	switch v := args[0].Value.(type) {
+	case *resultSet:
+		return &replayRows{rs: v}, nil
+	case error:
+		return nil, v
+	}
+	return nil, errReplayOnly
+}
+
+type replayRows struct {
+	rs   *resultSet
+	next int
+}
+
+func (r *replayRows) Columns() []string {
+	names := make([]string, len(r.rs.Columns))
+	for i, c := range r.rs.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func (r *replayRows) Close() error { return nil }
+
+func (r *replayRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rs.Rows) {
+		return io.EOF
+	}
+	for i, v := range r.rs.Rows[r.next] {
+		dest[i] = v.v
+	}
+	r.next++
+	return nil
+}
+
+// ColumnTypeScanType returns the recorded scan type, interface{} when it
+// is unknown to this process
+func (r *replayRows) ColumnTypeScanType(i int) reflect.Type {
+	if t, ok := scanTypes.Load(r.rs.Columns[i].ScanType); ok {
+		return t.(reflect.Type)
+	}
+	return reflect.TypeOf((*interface{})(nil)).Elem()
+}
+
+func (r *replayRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.rs.Columns[i].DBType
+}
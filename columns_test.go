@@ -0,0 +1,160 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// tagList is a custom column type stored as comma separated text
+type tagList []string
+
+func (t tagList) Value() (driver.Value, error) { return strings.Join(t, ","), nil }
+
+func (t *tagList) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		*t = strings.Split(v, ",")
+	case []byte:
+		*t = strings.Split(string(v), ",")
+	case nil:
+		*t = nil
+	default:
+		return fmt.Errorf("tagList: cannot scan %T", src)
+	}
+	return nil
+}
+
+// typedRow has a column of every type the JSON codec does not round trip
+type typedRow struct {
+	ID      uint
+	Created time.Time
+	Blob    []byte
+	Score   float64
+	Big     int64
+	Active  bool
+	Note    sql.NullString
+	Nick    *string
+	Tags    tagList
+}
+
+func newTypedDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := newTestDB(t, 0)
+	require.NoError(t, db.AutoMigrate(&typedRow{}))
+	nick := "nick"
+	rows := []typedRow{
+		{Created: time.Date(2023, 5, 1, 10, 30, 0, 123456789, time.FixedZone("IST", 5*3600+1800)), Blob: []byte{0, 1, 0xff}, Score: 0.1, Big: 1<<53 + 1, Active: true, Note: sql.NullString{String: "n", Valid: true}, Nick: &nick, Tags: tagList{"a", "b"}},
+		{Created: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Blob: []byte{}, Score: -2.5e-300, Big: -1},
+	}
+	require.NoError(t, db.Create(&rows).Error)
+	return db
+}
+
+var columnCases = []e2eCase{
+	{"structs", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var rows []typedRow
+		return &rows, db.Order("id").Find(&rows)
+	}},
+	{"first", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var row typedRow
+		return &row, db.First(&row, 1)
+	}},
+	{"first missing", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var row typedRow
+		return &row, db.First(&row, 100)
+	}},
+	{"model maps", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var rows []map[string]interface{}
+		return &rows, db.Model(&typedRow{}).Order("id").Find(&rows)
+	}},
+	{"table maps", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var rows []map[string]interface{}
+		return &rows, db.Table("typed_rows").Order("id").Find(&rows)
+	}},
+	{"pluck times", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var times []time.Time
+		return &times, db.Model(&typedRow{}).Order("id").Pluck("created", &times)
+	}},
+}
+
+// TestColumnsTypeFidelity checks that with Columns every column type comes
+// back from the cache exactly as the database returns it
+func TestColumnsTypeFidelity(t *testing.T) {
+	db := newTypedDB(t)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("columns_cache", client, gormcache.CacheConfig{TTL: time.Minute, Columns: true, CompressThreshold: 64})
+	require.NoError(t, db.Use(cache))
+
+	for _, c := range columnCases {
+		want, tx := c.run(db)
+		wantRows, wantErr := tx.RowsAffected, tx.Error
+
+		for _, pass := range []string{"miss", "hit"} {
+			got, tx := c.run(db.Session(&gorm.Session{Context: cacheCtx()}))
+			assert.Equal(t, want, got, "%s %s", c.name, pass)
+			assert.Equal(t, wantRows, tx.RowsAffected, "%s %s rows", c.name, pass)
+			assert.True(t, errors.Is(tx.Error, wantErr) || tx.Error == wantErr, "%s %s: %v, want %v", c.name, pass, tx.Error, wantErr)
+		}
+	}
+	// structs and both map cases run the same SQL and share one entry,
+	// replayed into each destination
+	assert.Equal(t, gormcache.Stats{Hits: 8, Misses: 4, Sets: 4}, cache.Stats())
+
+	keys, err := client.Keys(context.Background(), "")
+	require.NoError(t, err)
+	for _, key := range keys {
+		info, err := cache.Lookup(context.Background(), key)
+		require.NoError(t, err)
+		assert.True(t, info.Columns)
+		assert.Equal(t, 2, info.Version)
+	}
+}
+
+func TestColumnValues(t *testing.T) {
+	db := newTestDB(t, 0)
+	client := gormcache.NewMemoryClient()
+	require.NoError(t, db.Use(gormcache.NewGormCache("columns_cache", client, gormcache.CacheConfig{TTL: time.Minute, Columns: true})))
+
+	// values computed by SQLite rather than read from typed columns
+	type computed struct {
+		I int64
+		F float64
+		S string
+		N *int
+	}
+	query := func(ctx context.Context) (out []computed) {
+		require.NoError(t, db.WithContext(ctx).Raw("SELECT 9007199254740993 AS i, 0.1 AS f, 'é' AS s, NULL AS n").Find(&out).Error)
+		return out
+	}
+	want := query(context.Background())
+	assert.Equal(t, want, query(cacheCtx()))
+	assert.Equal(t, want, query(cacheCtx()))
+	assert.Equal(t, int64(9007199254740993), want[0].I)
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// userDTO is a projection of testUser with its own field names
+type userDTO struct {
+	ID       int    `json:"user_id"`
+	Name     string `json:"user_name"`
+	Extra    string `gorm:"-"`
+	Untagged bool   `gorm:"-" json:"-"`
+}
+
+// gobSerializer encodes payloads with encoding/gob, which only decodes
+// into the concrete destination type
+type gobSerializer struct{}
+
+func (gobSerializer) ID() uint8 { return 43 }
+
+func (gobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// destCases scan the same rows into destinations of other types than the
+// model. Cases sharing their SQL come in a row, so a shared key would show.
+var destCases = []e2eCase{
+	{"dto projection", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var dtos []userDTO
+		return &dtos, db.Model(&testUser{}).Select("id, name").Order("id").Find(&dtos)
+	}},
+	{"map projection", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var rows []map[string]interface{}
+		return &rows, db.Model(&testUser{}).Select("id, name").Order("id").Find(&rows)
+	}},
+	{"dto pointers", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var dtos []*userDTO
+		return &dtos, db.Model(&testUser{}).Select("id, name").Order("id").Find(&dtos)
+	}},
+	{"dto struct", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		dto := userDTO{Extra: "kept"}
+		return &dto, db.Model(&testUser{}).Select("id, name").Where("id = ?", 2).Find(&dto)
+	}},
+	{"single map", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		row := map[string]interface{}{}
+		return &row, db.Model(&testUser{}).Select("id, name").Where("id = ?", 2).Find(&row)
+	}},
+	{"pluck names", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var names []string
+		return &names, db.Model(&testUser{}).Order("id").Pluck("name", &names)
+	}},
+	{"pluck ids", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var ids []int64
+		return &ids, db.Model(&testUser{}).Order("id").Pluck("id", &ids)
+	}},
+	{"array", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var users [3]testUser
+		return &users, db.Order("id").Limit(2).Find(&users)
+	}},
+	{"array overflow", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var users [2]testUser
+		return &users, db.Order("id").Limit(4).Find(&users)
+	}},
+	{"raw dto", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var dtos []userDTO
+		return &dtos, db.Raw("SELECT id, name FROM test_users WHERE id < ?", 3).Scan(&dtos)
+	}},
+	{"raw maps", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var rows []map[string]interface{}
+		return &rows, db.Raw("SELECT id, name FROM test_users WHERE id < ?", 3).Scan(&rows)
+	}},
+}
+
+// TestDestinationTypes checks queries whose destination is not the model
+// against the uncached query, on a miss and on a hit
+func TestDestinationTypes(t *testing.T) {
+	configs := map[string]gormcache.CacheConfig{
+		"plain":    {TTL: time.Minute},
+		"envelope": {TTL: time.Minute, Envelope: true},
+		"columns":  {TTL: time.Minute, Columns: true},
+		"entities": {TTL: time.Minute, Entities: true, NormalizeLists: true},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t, 5)
+			cache := gormcache.NewGormCache("dest_cache", gormcache.NewMemoryClient(), config)
+			require.NoError(t, db.Use(cache))
+
+			for _, c := range destCases {
+				want, tx := c.run(db)
+				wantRows, wantErr := tx.RowsAffected, tx.Error
+				require.NoError(t, wantErr, c.name)
+
+				for _, pass := range []string{"miss", "hit"} {
+					got, tx := c.run(db.Session(&gorm.Session{Context: cacheCtx()}))
+					if strings.Contains(c.name, "map") && !config.Columns {
+						// maps decoded from JSON hold float64 numbers
+						assert.JSONEq(t, jsonOf(t, want), jsonOf(t, got), "%s %s", c.name, pass)
+					} else {
+						assert.Equal(t, want, got, "%s %s", c.name, pass)
+					}
+					assert.Equal(t, wantRows, tx.RowsAffected, "%s %s rows", c.name, pass)
+					assert.True(t, errors.Is(tx.Error, wantErr), "%s %s: %v", c.name, pass, tx.Error)
+				}
+			}
+			assert.Zero(t, cache.Stats().Errors)
+			assert.NotZero(t, cache.Stats().Hits)
+		})
+	}
+}
+
+// TestDestinationConcreteType checks that payloads are decoded into the
+// destination itself, as serializers other than JSON need
+func TestDestinationConcreteType(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache := gormcache.NewGormCache("gob_cache", gormcache.NewMemoryClient(), gormcache.CacheConfig{TTL: time.Minute, Envelope: true, Serializer: gobSerializer{}})
+	require.NoError(t, db.Use(cache))
+
+	for i := 0; i < 2; i++ {
+		var dtos []userDTO
+		require.NoError(t, db.WithContext(cacheCtx()).Model(&testUser{}).Select("id, name").Order("id").Find(&dtos).Error)
+		assert.Equal(t, []userDTO{{ID: 1, Name: "user1"}, {ID: 2, Name: "user2"}, {ID: 3, Name: "user3"}}, dtos)
+
+		var names []string
+		require.NoError(t, db.WithContext(cacheCtx()).Model(&testUser{}).Order("id").Pluck("name", &names).Error)
+		assert.Equal(t, []string{"user1", "user2", "user3"}, names)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 2, Misses: 2, Sets: 2}, cache.Stats())
+}
+
+func jsonOf(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(data)
+}
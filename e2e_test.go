@@ -0,0 +1,117 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// e2eCase runs a query into a fresh destination and returns it
+type e2eCase struct {
+	name string
+	run  func(db *gorm.DB) (interface{}, *gorm.DB)
+}
+
+var e2eCases = []e2eCase{
+	{"find all", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var users []testUser
+		return &users, db.Order("id").Find(&users)
+	}},
+	{"find pointers", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var users []*testUser
+		return &users, db.Where("id > ?", 2).Order("id").Find(&users)
+	}},
+	{"find none", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var users []testUser
+		return &users, db.Where("id > ?", 100).Find(&users)
+	}},
+	{"find limit", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var users []testUser
+		return &users, db.Order("id DESC").Limit(2).Find(&users)
+	}},
+	{"find struct", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var user testUser
+		return &user, db.Where("name = ?", "user2").Find(&user)
+	}},
+	{"find struct none", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		user := testUser{Name: "untouched"}
+		return &user, db.Where("name = ?", "nobody").Find(&user)
+	}},
+	{"first", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var user testUser
+		return &user, db.First(&user, 3)
+	}},
+	{"first missing", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		user := testUser{Name: "untouched"}
+		return &user, db.First(&user, 100)
+	}},
+	{"take missing", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var user testUser
+		return &user, db.Where("name = ?", "nobody").Take(&user)
+	}},
+	{"last", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var user testUser
+		return &user, db.Last(&user)
+	}},
+	{"pluck", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var names []string
+		return &names, db.Model(&testUser{}).Order("id").Pluck("name", &names)
+	}},
+	{"count", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var count int64
+		return &count, db.Model(&testUser{}).Where("id < ?", 4).Count(&count)
+	}},
+}
+
+// TestEndToEnd checks that a cache miss and a cache hit give the same
+// destination, RowsAffected and error as the uncached query
+func TestEndToEnd(t *testing.T) {
+	configs := map[string]gormcache.CacheConfig{
+		"plain":    {TTL: time.Minute},
+		"envelope": {TTL: time.Minute, Envelope: true, Metadata: true},
+		"entities": {TTL: time.Minute, Entities: true, NormalizeLists: true},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t, 5)
+			cache := gormcache.NewGormCache("e2e_cache", gormcache.NewMemoryClient(), config)
+			require.NoError(t, db.Use(cache))
+
+			for _, c := range e2eCases {
+				want, tx := c.run(db)
+				wantRows, wantErr := tx.RowsAffected, tx.Error
+
+				for _, pass := range []string{"miss", "hit"} {
+					got, tx := c.run(db.Session(&gorm.Session{Context: cacheCtx()}))
+					assert.Equal(t, want, got, "%s %s", c.name, pass)
+					assert.Equal(t, wantRows, tx.RowsAffected, "%s %s rows", c.name, pass)
+					assert.True(t, errors.Is(tx.Error, wantErr) || tx.Error == wantErr, "%s %s: %v, want %v", c.name, pass, tx.Error, wantErr)
+				}
+			}
+			stats := cache.Stats()
+			assert.Zero(t, stats.Errors)
+			assert.NotZero(t, stats.Hits)
+		})
+	}
+}
@@ -0,0 +1,339 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"regexp"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// pkExpr matches a raw condition comparing a single column to one
+// placeholder, e.g. "id = ?" or "`users`.`id` = ?"
+var pkExpr = regexp.MustCompile("^\\s*(?:[`\"]?\\w+[`\"]?\\.)?[`\"]?(\\w+)[`\"]?\\s*=\\s*\\?\\s*$")
+
+// entityClauses are the clauses a primary-key lookup may carry, the last
+// one is the marker of the soft delete scope
+var entityClauses = map[string]bool{"SELECT": true, "FROM": true, "WHERE": true, "ORDER BY": true, "LIMIT": true, "soft_delete_enabled": true}
+
+// deletedAtType is the type of the soft delete field
+var deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+
+// entityKey returns the key of the entity of model s with primary key pk,
+// after prefix, the start of the keys of the query as given by keyPrefix.
+// Values of different Go types printing the same, e.g. 42 and "42", map
+// to the same entity. The printed key is path-escaped, so spaces, control
+// characters and the like never reach the client and two keys never escape
+// to the same one.
+func (g *GormCache) entityKey(prefix string, s *schema.Schema, pk interface{}) string {
+	key := prefix + "entity:" + s.Table + ":"
+	if g.config.SchemaFingerprint {
+		key += modelFingerprint(s) + ":"
+	}
+	return key + url.PathEscape(fmt.Sprint(pk))
+}
+
+// entityField returns the primary field of a model with a single primary key
+func entityField(s *schema.Schema) *schema.Field {
+	if s == nil || len(s.PrimaryFields) != 1 {
+		return nil
+	}
+	return s.PrioritizedPrimaryField
+}
+
+// isColumn reports whether col, a clause column or a raw column name,
+// names the field in the statement table
+func isColumn(stmt *gorm.Statement, col interface{}, field *schema.Field) bool {
+	switch c := col.(type) {
+	case clause.Column:
+		if c.Raw || (c.Table != "" && c.Table != clause.CurrentTable && c.Table != stmt.Table) {
+			return false
+		}
+		return c.Name == field.DBName || (c.Name == clause.PrimaryKey && field.PrimaryKey)
+	case string:
+		m := pkExpr.FindStringSubmatch(c + " = ?")
+		return m != nil && m[1] == field.DBName
+	}
+	return false
+}
+
+// pkValues returns the primary key values a condition restricts the
+// statement to, ok false when it is not a condition on the primary key
+func pkValues(stmt *gorm.Statement, field *schema.Field, expr clause.Expression) (values []interface{}, ok bool) {
+	switch e := expr.(type) {
+	case clause.Eq:
+		if isColumn(stmt, e.Column, field) && e.Value != nil {
+			return []interface{}{e.Value}, true
+		}
+	case clause.IN:
+		if isColumn(stmt, e.Column, field) {
+			return e.Values, true
+		}
+	case clause.Expr:
+		if m := pkExpr.FindStringSubmatch(e.SQL); m != nil && m[1] == field.DBName && len(e.Vars) == 1 {
+			return e.Vars, true
+		}
+	case clause.AndConditions:
+		if len(e.Exprs) == 1 {
+			return pkValues(stmt, field, e.Exprs[0])
+		}
+	}
+	return nil, false
+}
+
+// isNotDeleted reports whether expr is the soft delete condition of the
+// default scope
+func isNotDeleted(stmt *gorm.Statement, expr clause.Expression) bool {
+	eq, ok := expr.(clause.Eq)
+	if !ok {
+		return false
+	}
+	if zero, ok := eq.Value.(sql.NullString); eq.Value != nil && (!ok || zero.Valid) {
+		return false // deleted_at IS NULL, not a ZEROVALUE tag
+	}
+	for _, field := range stmt.Schema.Fields {
+		if field.FieldType == deletedAtType && isColumn(stmt, eq.Column, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// whereExprs returns the top level conditions of the statement
+func whereExprs(stmt *gorm.Statement) []clause.Expression {
+	c, ok := stmt.Clauses["WHERE"]
+	if !ok {
+		return nil
+	}
+	where, _ := c.Expression.(clause.Where)
+	return where.Exprs
+}
+
+// entityLookup returns the entity key of a query fetching one row of its
+// model by primary key, whatever the SQL shape, ok false for any other
+// query. Models with soft delete are only looked up through the default
+// scope, so entities never hold deleted rows.
+func (g *GormCache) entityLookup(db *gorm.DB) (key string, ok bool) {
+	stmt := db.Statement
+	field := entityField(stmt.Schema)
+	if field == nil || stmt.Table != stmt.Schema.Table || len(stmt.Joins) > 0 || len(stmt.Selects) > 0 || len(stmt.Omits) > 0 || stmt.Distinct {
+		return "", false
+	}
+	if !stmt.ReflectValue.IsValid() || stmt.ReflectValue.Type() != stmt.Schema.ModelType {
+		return "", false // not scanned into a single model
+	}
+	for name := range stmt.Clauses {
+		if !entityClauses[name] {
+			return "", false
+		}
+	}
+	if c, ok := stmt.Clauses["LIMIT"]; ok {
+		if limit, _ := c.Expression.(clause.Limit); limit.Offset > 0 {
+			return "", false
+		}
+	}
+
+	var pk []interface{}
+	softDelete, scoped := hasSoftDelete(stmt.Schema), false
+	for _, expr := range whereExprs(stmt) {
+		if softDelete && isNotDeleted(stmt, expr) {
+			scoped = true
+			continue
+		}
+		values, ok := pkValues(stmt, field, expr)
+		if !ok || len(values) != 1 || pk != nil {
+			return "", false
+		}
+		pk = values
+	}
+	if pk == nil || softDelete && !scoped {
+		return "", false
+	}
+	prefix, err := g.keyPrefix(db)
+	if err != nil {
+		return "", false // left to the query key, which fails the same way
+	}
+	return g.entityKey(prefix, stmt.Schema, pk[0]), true
+}
+
+// hasSoftDelete reports whether the model has a gorm.DeletedAt field
+func hasSoftDelete(s *schema.Schema) bool {
+	for _, field := range s.Fields {
+		if field.FieldType == deletedAtType {
+			return true
+		}
+	}
+	return false
+}
+
+// writtenEntities returns the primary keys a write is restricted to, ok
+// false when it may touch rows not named by primary key. Every condition
+// must be on the primary key or the soft delete scope: an OR, a NOT or
+// anything else not understood may widen the write.
+func writtenEntities(stmt *gorm.Statement) (pks []interface{}, ok bool) {
+	field := entityField(stmt.Schema)
+	if field == nil {
+		return nil, false
+	}
+	for _, expr := range whereExprs(stmt) {
+		if isNotDeleted(stmt, expr) {
+			continue
+		}
+		values, ok := pkValues(stmt, field, expr)
+		if !ok {
+			return nil, false
+		}
+		pks = append(pks, values...)
+	}
+	return pks, len(pks) > 0
+}
+
+// entityCallback returns a callback refreshing the entities an update
+// wrote, or dropping them for deletes. Writes not restricted by primary
+// key drop every entity of the table when the client implements Tagger.
+func (g *GormCache) entityCallback(drop bool) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || db.DryRun || db.RowsAffected == 0 || entityField(db.Statement.Schema) == nil {
+			return
+		}
+		ctx, s := context.WithoutCancel(db.Statement.Context), db.Statement.Schema
+		pks, ok := writtenEntities(db.Statement)
+		prefix, err := g.keyPrefix(db)
+		if err != nil {
+			ok = false // the entities of another scope cannot be named
+		}
+
+		var op func()
+		switch {
+		case !ok:
+			if _, tagger := g.client.(Tagger); !tagger {
+				return // entities of the table age out on their TTL
+			}
+			op = func() {
+				if err := g.PurgeTable(ctx, s.Table); err != nil {
+					log.Printf("*** purge entities of %v failed: %v", s.Table, err)
+				}
+			}
+		case drop || inTransaction(db) && g.bufferedTxOf(db) == nil:
+			// rows written by an unbuffered transaction cannot be read
+			// before it commits
+			op = func() { g.dropEntities(ctx, prefix, s, pks) }
+		case neverCached(s):
+			return // never cached
+		default:
+			op = func() { g.refreshEntities(ctx, prefix, s, pks) }
+		}
+
+		if tx := g.bufferedTxOf(db); tx != nil {
+			tx.buffer(op)
+			return
+		}
+		op()
+		if tx := txOf(db); tx != nil {
+			tx.buffer(op) // a read outside the transaction may store the old rows again before it commits
+		}
+	}
+}
+
+// dropEntities deletes the entities of model s with the given keys
+func (g *GormCache) dropEntities(ctx context.Context, prefix string, s *schema.Schema, pks []interface{}) {
+	if len(pks) == 0 {
+		return
+	}
+	keys := make([]string, len(pks))
+	for i, pk := range pks {
+		keys[i] = g.entityKey(prefix, s, pk)
+	}
+	if err := g.Purge(ctx, keys...); err != nil {
+		log.Printf("*** drop entities of %v failed: %v", s.Table, err)
+	}
+}
+
+// refreshEntities reloads the entities of model s with the given keys
+// from the database and stores them, dropping the ones no longer found
+func (g *GormCache) refreshEntities(ctx context.Context, prefix string, s *schema.Schema, pks []interface{}) {
+	rows := reflect.New(reflect.SliceOf(s.ModelType))
+	tx := g.db.Session(&gorm.Session{NewDB: true, Context: context.WithValue(ctx, UseCacheKey, false)})
+	if tx = tx.Find(rows.Interface(), pks); tx.Error != nil {
+		log.Printf("*** refresh entities of %v failed: %v", s.Table, tx.Error)
+		g.dropEntities(ctx, prefix, s, pks)
+		return
+	}
+
+	found := g.storeEntities(ctx, tx, prefix, s, rows.Elem(), g.jitter(g.modelTTL(s)))
+	var gone []interface{}
+	for _, pk := range pks {
+		if !found[g.entityKey(prefix, s, pk)] {
+			gone = append(gone, pk)
+		}
+	}
+	g.dropEntities(ctx, prefix, s, gone)
+}
+
+// storeEntities stores each row of rows, a slice of models or of model
+// pointers read by db, as an entity with keys after prefix. It returns the
+// keys stored.
+func (g *GormCache) storeEntities(ctx context.Context, db *gorm.DB, prefix string, s *schema.Schema, rows reflect.Value, ttl time.Duration) map[string]bool {
+	field := entityField(s)
+	tagger, _ := g.client.(Tagger)
+	stored := make(map[string]bool, rows.Len())
+	for i := 0; i < rows.Len(); i++ {
+		row := reflect.Indirect(rows.Index(i))
+		pk, _ := field.ValueOf(ctx, row)
+		key := g.entityKey(prefix, s, pk)
+
+		var meta *EntryMeta
+		if g.config.Metadata {
+			meta = g.newMeta(db, db.Statement.SQL.String(), db.Statement.Vars, []string{s.Table}, 1, row.Addr().Interface(), ttl)
+		}
+		payload, err := g.encodeEntry(meta, row.Addr().Interface(), ttl)
+		if err == nil && g.tooLarge(key, payload) {
+			continue
+		}
+		if err == nil {
+			err = g.client.Set(ctx, key, storable(payload), ttl)
+		}
+		if err != nil {
+			log.Printf("*** set entity %v failed: %v", key, err)
+			continue
+		}
+		stored[key] = true
+		if tagger != nil {
+			if err = tagger.Tag(ctx, key, []string{g.tagKey(TableTag(s.Table))}, ttl); err != nil {
+				log.Printf("*** tag cache failed: %v", err)
+			}
+		}
+	}
+	return stored
+}
+
+// registerEntities registers entityCallback after updates and deletes
+func (g *GormCache) registerEntities(db *gorm.DB) error {
+	if err := db.Callback().Update().After("gorm:update").Register("gormcache:entity", g.entityCallback(false)); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("gormcache:entity", g.entityCallback(true))
+}
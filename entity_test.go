@@ -0,0 +1,210 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// softUser is a model with soft delete
+type softUser struct {
+	ID        int
+	Name      string
+	DeletedAt gorm.DeletedAt
+}
+
+// codeUser is a model with a string primary key
+type codeUser struct {
+	Code string `gorm:"primaryKey"`
+	Name string
+}
+
+func newEntityCache(t *testing.T, db *gorm.DB) (*gormcache.GormCache, *gormcache.MemoryClient) {
+	t.Helper()
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("entity_cache", client, gormcache.CacheConfig{TTL: time.Minute, Entities: true})
+	require.NoError(t, db.Use(cache))
+	return cache, client
+}
+
+func TestEntityLookupShapes(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, client := newEntityCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	lookups := []func(u *testUser) error{
+		func(u *testUser) error { return cdb.First(u, 2).Error },
+		func(u *testUser) error { return cdb.Where("id = ?", 2).First(u).Error },
+		func(u *testUser) error { return cdb.Take(u, "`id` = ?", int64(2)).Error },
+		func(u *testUser) error { return cdb.Where(&testUser{ID: 2}).Find(u).Error },
+		func(u *testUser) error { return cdb.Last(u, "2").Error },
+	}
+	for _, lookup := range lookups {
+		var user testUser
+		require.NoError(t, lookup(&user))
+		assert.Equal(t, testUser{ID: 2, Name: "user2"}, user)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 4, Misses: 1, Sets: 1}, cache.Stats())
+	assert.Equal(t, "entity:test_users:2", onlyKey(t, client))
+}
+
+func TestEntityKeyEscaped(t *testing.T) {
+	db := newTestDB(t, 0)
+	require.NoError(t, db.AutoMigrate(&codeUser{}))
+	require.NoError(t, db.Create(&[]codeUser{{Code: "a b", Name: "spaced"}, {Code: "a%20b", Name: "escaped"}}).Error)
+	_, client := newEntityCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	for _, want := range []codeUser{{Code: "a b", Name: "spaced"}, {Code: "a%20b", Name: "escaped"}} {
+		var user codeUser
+		require.NoError(t, cdb.First(&user, "code = ?", want.Code).Error)
+		assert.Equal(t, want, user)
+	}
+	keys, err := client.Keys(context.Background(), "entity:")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"entity:code_users:a%20b", "entity:code_users:a%2520b"}, keys)
+
+	// each key reads back its own row
+	for _, want := range []codeUser{{Code: "a b", Name: "spaced"}, {Code: "a%20b", Name: "escaped"}} {
+		var user codeUser
+		require.NoError(t, cdb.First(&user, "code = ?", want.Code).Error)
+		assert.Equal(t, want, user)
+	}
+}
+
+func TestEntityNotForOtherQueries(t *testing.T) {
+	db := newTestDB(t, 3)
+	_, client := newEntityCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	require.NoError(t, cdb.Where("name = ?", "user1").First(&testUser{}).Error)
+	require.NoError(t, cdb.Where("id = ? AND name = ?", 1, "user1").First(&testUser{}).Error)
+	require.NoError(t, cdb.Find(&[]testUser{}, 1).Error)
+	require.NoError(t, cdb.Select("name").First(&testUser{}, 1).Error)
+	require.NoError(t, cdb.Offset(1).Find(&testUser{}, 1).Error)
+
+	keys, err := client.Keys(context.Background(), "entity:")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, 5, client.Len())
+}
+
+func TestEntityRefreshedByUpdate(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, client := newEntityCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	var user testUser
+	require.NoError(t, cdb.First(&user, 2).Error)
+	require.NoError(t, db.Model(&testUser{ID: 2}).Update("name", "renamed").Error)
+
+	info, err := cache.Lookup(context.Background(), "entity:test_users:2")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ID":2,"Name":"renamed"}`, string(info.Value), "refreshed in place")
+
+	user = testUser{}
+	require.NoError(t, cdb.Where("id = ?", 2).First(&user).Error)
+	assert.Equal(t, "renamed", user.Name)
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+
+	// deletes drop the entity
+	require.NoError(t, db.Delete(&testUser{ID: 2}).Error)
+	assert.Equal(t, 0, client.Len())
+	assert.ErrorIs(t, cdb.First(&testUser{}, 2).Error, gorm.ErrRecordNotFound)
+}
+
+func TestEntityBulkWrites(t *testing.T) {
+	db := newTestDB(t, 3)
+	_, client := newEntityCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	require.NoError(t, cdb.First(&testUser{}, 1).Error)
+	require.NoError(t, cdb.First(&testUser{}, 2).Error)
+	require.Equal(t, 2, client.Len())
+
+	// not restricted by primary key, every entity of the table goes
+	require.NoError(t, db.Model(&testUser{}).Where("name LIKE ?", "user%").Update("name", "x").Error)
+	assert.Equal(t, 0, client.Len())
+
+	var user testUser
+	require.NoError(t, cdb.First(&user, 1).Error)
+	assert.Equal(t, "x", user.Name)
+
+	// a primary key ORed with another condition names only some rows
+	require.NoError(t, cdb.First(&testUser{}, 2).Error)
+	require.NoError(t, cdb.First(&testUser{}, 3).Error)
+	require.NoError(t, db.Model(&testUser{}).Where("id = ?", 2).Or("id = ?", 3).Update("name", "y").Error)
+	assert.Equal(t, 0, client.Len())
+
+	user = testUser{}
+	require.NoError(t, cdb.First(&user, 3).Error)
+	assert.Equal(t, "y", user.Name)
+}
+
+func TestEntityInTransaction(t *testing.T) {
+	for _, policy := range []gormcache.TxPolicy{gormcache.TxBypass, gormcache.TxBuffer} {
+		db := newTestDB(t, 2)
+		client := gormcache.NewMemoryClient()
+		require.NoError(t, db.Use(gormcache.NewGormCache("entity_cache", client, gormcache.CacheConfig{TTL: time.Minute, Entities: true, TxPolicy: policy})))
+		cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+		require.NoError(t, cdb.First(&testUser{}, 1).Error)
+		stale, err := client.Get(context.Background(), "entity:test_users:1")
+		require.NoError(t, err)
+		require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&testUser{ID: 1}).Update("name", "committed").Error; err != nil {
+				return err
+			}
+			// a read outside the transaction stores the old row again
+			return client.Set(context.Background(), "entity:test_users:1", stale, time.Minute)
+		}))
+
+		var user testUser
+		require.NoError(t, cdb.First(&user, 1).Error)
+		assert.Equal(t, "committed", user.Name, "policy %v", policy)
+	}
+}
+
+func TestEntitySoftDelete(t *testing.T) {
+	db := newTestDB(t, 0)
+	require.NoError(t, db.AutoMigrate(&softUser{}))
+	require.NoError(t, db.Create(&softUser{ID: 1, Name: "soft"}).Error)
+	_, client := newEntityCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	require.NoError(t, cdb.First(&softUser{}, 1).Error)
+	assert.Equal(t, "entity:soft_users:1", onlyKey(t, client))
+
+	require.NoError(t, db.Delete(&softUser{ID: 1}).Error)
+	assert.Equal(t, 0, client.Len())
+	assert.ErrorIs(t, cdb.First(&softUser{}, 1).Error, gorm.ErrRecordNotFound)
+
+	// unscoped lookups may see deleted rows, they never use the entity
+	var user softUser
+	require.NoError(t, cdb.Unscoped().First(&user, 1).Error)
+	assert.True(t, user.DeletedAt.Valid)
+	keys, err := client.Keys(context.Background(), "entity:")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
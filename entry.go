@@ -0,0 +1,242 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EntryMeta describes the query a cache entry was produced by
+type EntryMeta struct {
+	SQL       string        `json:"sql"`              // explained SQL, or with placeholders when RedactSQL is set
+	Tables    []string      `json:"tables,omitempty"` // tables the query reads
+	CreatedAt time.Time     `json:"created_at"`
+	TTL       time.Duration `json:"ttl"`
+	Rows      int64         `json:"rows"` // rows scanned into the destination
+	Type      string        `json:"type"` // Go type of the destination
+}
+
+// entryEnvelope is the legacy JSON form of an entry stored with metadata
+// outside the binary envelope. The marker field name is unlikely to clash
+// with a model field, so bare payloads are still told apart.
+type entryEnvelope struct {
+	Meta *EntryMeta  `json:"_gormcache"`
+	Data interface{} `json:"data"`
+}
+
+// storedEnvelope is entryEnvelope as read back
+type storedEnvelope struct {
+	Meta *EntryMeta      `json:"_gormcache"`
+	Data json.RawMessage `json:"data"`
+}
+
+// storedEntry is a decoded cache entry
+type storedEntry struct {
+	Version    int // envelope format version, 0 for header-less JSON
+	Serializer Serializer
+	Compressed bool
+	Columns    bool      // the payload is a column result set, replayed through the scanner
+	CreatedAt  time.Time // zero when unknown
+	ExpiresAt  time.Time // zero when it never expires or is unknown
+	Meta       *EntryMeta
+	Payload    []byte // serialized destination, decompressed
+}
+
+// expired reports whether the entry outlived the expiry recorded in it
+func (e *storedEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// notFound reports whether the entry holds a single record that was not
+// found, stored as the serialized nil
+func (e *storedEntry) notFound() bool {
+	null, err := e.Serializer.Marshal(nil)
+	return err == nil && bytes.Equal(bytes.TrimSpace(e.Payload), null)
+}
+
+// result returns what to store for the destination of a query: nil when
+// a single record was not found, so a hit can tell it from a found row.
+// An array is stored as a slice of its scanned rows, padded with zero
+// values for the rows it had no room for, so a hit restores RowsAffected.
+func result(dest interface{}, rv reflect.Value, rows int64) interface{} {
+	switch {
+	case !rv.IsValid():
+		return dest
+	case rv.Kind() == reflect.Array:
+		out := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), int(rows), int(rows))
+		reflect.Copy(out, rv.Slice(0, min(int(rows), rv.Len())))
+		return out.Interface()
+	case rows == 0 && rv.Kind() != reflect.Slice:
+		return nil
+	}
+	return dest
+}
+
+// decodeResult decodes a payload stored by result into rv, the concrete
+// destination, and returns the rows it holds as the database path counts
+// them: the length of a slice, 1 for anything else
+func decodeResult(s Serializer, payload []byte, rv reflect.Value) (int64, error) {
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return 0, errors.New("gormcache: no destination to decode into")
+	case reflect.Array:
+		rows := reflect.New(reflect.SliceOf(rv.Type().Elem()))
+		if err := s.Unmarshal(payload, rows.Interface()); err != nil {
+			return 0, err
+		}
+		rv.Set(reflect.Zero(rv.Type()))
+		reflect.Copy(rv, rows.Elem())
+		return int64(rows.Elem().Len()), nil
+	}
+
+	target := reflect.New(rv.Type())
+	if rv.CanAddr() {
+		target = rv.Addr()
+	} else {
+		target.Elem().Set(rv) // a map passed by value, filled in place
+	}
+	if err := s.Unmarshal(payload, target.Interface()); err != nil {
+		return 0, err
+	}
+	if rv.Kind() == reflect.Slice {
+		return int64(target.Elem().Len()), nil
+	}
+	return 1, nil
+}
+
+// isScalar reports whether rv is a scalar destination, e.g. of Count or
+// of an aggregate scanned with Select(...).Scan
+func isScalar(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// compactScalar reports whether a result is stored as its bare value: a
+// scalar read from at most one row. A scalar scanned from several rows,
+// e.g. a Count with Group, is stored as columns to keep the row count
+// Count reports.
+func compactScalar(rv reflect.Value, rows int64) bool {
+	return isScalar(rv) && rows <= 1
+}
+
+// destinationType returns a description of the destination type of a
+// query when it is not the model, or a slice or array of it, so keys of
+// the same SQL scanned into DTOs, maps or scalars do not collide
+func destinationType(db *gorm.DB) string {
+	rv := db.Statement.ReflectValue
+	if !rv.IsValid() {
+		return ""
+	}
+	t := rv.Type()
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if s := db.Statement.Schema; s != nil && t == s.ModelType {
+		return ""
+	}
+	return typeFingerprint(rv.Type())
+}
+
+// newMeta builds the metadata of an entry
+func (g *GormCache) newMeta(db *gorm.DB, sql string, vars []interface{}, tables []string, rows int64, dest interface{}, ttl time.Duration) *EntryMeta {
+	if !g.config.RedactSQL {
+		sql = db.Dialector.Explain(sql, vars...)
+	}
+	return &EntryMeta{
+		SQL:       sql,
+		Tables:    tables,
+		CreatedAt: time.Now().UTC(),
+		TTL:       ttl,
+		Rows:      rows,
+		Type:      reflect.TypeOf(dest).String(),
+	}
+}
+
+// payload encodes the destination of a query for storage, or the column
+// values it was scanned from when they were recorded, with its metadata
+// when Metadata is set
+func (g *GormCache) payload(db *gorm.DB, ttl time.Duration) ([]byte, error) {
+	var meta *EntryMeta
+	if g.config.Metadata {
+		meta = g.newMeta(db, db.Statement.SQL.String(), db.Statement.Vars, queryTables(db), db.RowsAffected, db.Statement.Dest, ttl)
+	}
+	rs, _ := db.InstanceGet(columnsKey)
+	if rs, _ := rs.(*resultSet); rs != nil && !compactScalar(db.Statement.ReflectValue, db.RowsAffected) {
+		return g.encodeColumns(meta, rs, ttl)
+	}
+	return g.encodeEntry(meta, result(db.Statement.Dest, db.Statement.ReflectValue, db.RowsAffected), ttl)
+}
+
+// encodeEntry encodes dest in the binary envelope when Envelope is set,
+// and as header-less JSON otherwise
+func (g *GormCache) encodeEntry(meta *EntryMeta, dest interface{}, ttl time.Duration) ([]byte, error) {
+	if g.config.Envelope {
+		return encodeEnvelope(g.serializer(), g.config.CompressThreshold, meta, dest, ttl)
+	}
+	if meta != nil {
+		return json.Marshal(entryEnvelope{Meta: meta, Data: dest})
+	}
+	return json.Marshal(dest)
+}
+
+// storable returns what to pass to CacheClient.Set for encoded data:
+// JSON as a json.RawMessage, which clients encoding values with
+// json.Marshal store unchanged, and binary envelopes as []byte, which
+// must be stored verbatim
+func storable(data []byte) interface{} {
+	if bytes.HasPrefix(data, envelopeMagic[:]) {
+		return data
+	}
+	return json.RawMessage(data)
+}
+
+// decodeEntry decodes stored bytes, dispatching on the envelope version.
+// Header-less JSON entries are read as version 0.
+func decodeEntry(data []byte) (*storedEntry, error) {
+	if bytes.HasPrefix(data, envelopeMagic[:]) {
+		return decodeEnvelope(data)
+	}
+
+	entry := &storedEntry{Serializer: JSONSerializer{}, Payload: data}
+	if len(data) == 0 || data[0] != '{' {
+		return entry, nil
+	}
+	var env storedEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Meta == nil {
+		return entry, nil
+	}
+	entry.Meta, entry.Payload = env.Meta, env.Data
+	entry.CreatedAt = env.Meta.CreatedAt
+	if env.Meta.TTL > 0 {
+		entry.ExpiresAt = env.Meta.CreatedAt.Add(env.Meta.TTL)
+	}
+	return entry, nil
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// onlyKey returns the single cache entry key of client
+func onlyKey(t *testing.T, client *gormcache.MemoryClient) string {
+	t.Helper()
+	keys, err := client.Keys(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	return keys[0]
+}
+
+func TestEntryMetadata(t *testing.T) {
+	for _, redact := range []bool{false, true} {
+		db := newTestDB(t, 3)
+		client := gormcache.NewMemoryClient()
+		cache := gormcache.NewGormCache("meta_cache", client, gormcache.CacheConfig{
+			TTL:       time.Minute,
+			Metadata:  true,
+			RedactSQL: redact,
+		})
+		require.NoError(t, db.Use(cache))
+
+		var users []testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Where("id > ?", 1).Find(&users).Error)
+
+		info, err := cache.Lookup(context.Background(), onlyKey(t, client))
+		require.NoError(t, err)
+		require.NotNil(t, info.Meta)
+		if redact {
+			assert.Equal(t, "SELECT * FROM `test_users` WHERE id > ?", info.Meta.SQL)
+		} else {
+			assert.Equal(t, "SELECT * FROM `test_users` WHERE id > 1", info.Meta.SQL)
+		}
+		assert.Equal(t, []string{"test_users"}, info.Meta.Tables)
+		assert.Equal(t, int64(2), info.Meta.Rows)
+		assert.Equal(t, "*[]gormcache_test.testUser", info.Meta.Type)
+		assert.Equal(t, time.Minute, info.Meta.TTL)
+		assert.WithinDuration(t, time.Now(), info.Meta.CreatedAt, time.Minute)
+		assert.JSONEq(t, `[{"ID":2,"Name":"user2"},{"ID":3,"Name":"user3"}]`, string(info.Value))
+
+		// the envelope is transparent on cache hits
+		users = nil
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Where("id > ?", 1).Find(&users).Error)
+		assert.Equal(t, []testUser{{ID: 2, Name: "user2"}, {ID: 3, Name: "user3"}}, users)
+		assert.Equal(t, uint64(1), cache.Stats().Hits)
+	}
+}
+
+func TestEntryWithoutMetadata(t *testing.T) {
+	db := newTestDB(t, 1)
+	client := gormcache.NewMemoryClient()
+	require.NoError(t, db.Use(gormcache.NewGormCache("plain_cache", client, gormcache.CacheConfig{TTL: time.Minute})))
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&[]testUser{}).Error)
+	key := onlyKey(t, client)
+
+	// entries stored without metadata are read by a cache storing it
+	cache := gormcache.NewGormCache("meta_cache", client, gormcache.CacheConfig{TTL: time.Minute, Metadata: true})
+	info, err := cache.Lookup(context.Background(), key)
+	require.NoError(t, err)
+	assert.Nil(t, info.Meta)
+	assert.JSONEq(t, `[{"ID":1,"Name":"user1"}]`, string(info.Value))
+}
+
+// marshalingClient stores every value as its JSON, like clients written
+// before entries were encoded by the plugin
+type marshalingClient struct {
+	*mockCacheClient
+}
+
+func (m marshalingClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return m.mockCacheClient.Set(ctx, key, data, ttl)
+}
+
+func TestEntryWithMarshalingClient(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := marshalingClient{newMockCacheClient()}
+	cache := gormcache.NewGormCache("entry_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	for i := 0; i < 2; i++ {
+		var users []testUser
+		require.NoError(t, db.WithContext(cacheCtx()).Order("id").Find(&users).Error)
+		assert.Equal(t, []testUser{{ID: 1, Name: "user1"}, {ID: 2, Name: "user2"}}, users)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+
+	// the JSON of the destination, not a base64 string of it
+	require.Len(t, client.store, 1)
+	for _, data := range client.store {
+		assert.JSONEq(t, `[{"ID":1,"Name":"user1"},{"ID":2,"Name":"user2"}]`, string(data))
+	}
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Binary envelope, version 1. All integers are big endian.
+//
+//	offset  size  field
+//	0       4     magic 0xC4 'G' 'C' 'E', never the start of JSON
+//	4       1     format version
+//	5       1     serializer ID
+//	6       1     flags, bit 0 set when the payload is gzip compressed
+//	7       8     created-at, Unix nanoseconds
+//	15      8     expires-at, Unix nanoseconds, 0 when it never expires
+//	23      4     metadata length n, 0 when stored without metadata
+//	27      n     metadata, EntryMeta as JSON
+//	27+n    ...   serialized payload
+//
+// Version 2 has the same layout and adds flag bit 1, set when the payload
+// is a column result set instead of the serialized destination. Column
+// entries are always written as version 2, so readers that only know
+// version 1 reject them instead of misreading them.
+const (
+	envelopeVersion   = 1
+	envelopeHeaderLen = 27
+	flagGzip          = 1 << 0
+	flagColumns       = 1 << 1
+)
+
+var envelopeMagic = [4]byte{0xC4, 'G', 'C', 'E'}
+
+// ErrBadEnvelope is returned when stored bytes carry the envelope magic
+// but cannot be decoded
+var ErrBadEnvelope = errors.New("gormcache: malformed cache entry envelope")
+
+// Serializer encodes query destinations inside the binary envelope. Its
+// ID is stored in each entry, so it must be unique and never change.
+type Serializer interface {
+	ID() uint8
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONSerializer encodes with encoding/json. Its ID is 1.
+type JSONSerializer struct{}
+
+// ID returns the serializer ID
+func (JSONSerializer) ID() uint8 { return 1 }
+
+// Marshal encodes v as JSON
+func (JSONSerializer) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal decodes JSON data into v
+func (JSONSerializer) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+var serializers sync.Map // uint8 -> Serializer
+
+func init() {
+	RegisterSerializer(JSONSerializer{})
+}
+
+// RegisterSerializer makes a serializer available to decode the entries
+// it encoded. Serializers set in CacheConfig are registered by
+// NewGormCache.
+func RegisterSerializer(s Serializer) {
+	serializers.Store(s.ID(), s)
+}
+
+// serializer returns the configured serializer, JSON by default
+func (g *GormCache) serializer() Serializer {
+	if g.config.Serializer != nil {
+		return g.config.Serializer
+	}
+	return JSONSerializer{}
+}
+
+// encodeEnvelope encodes dest in the current envelope version
+func encodeEnvelope(s Serializer, compressThreshold int, meta *EntryMeta, dest interface{}, ttl time.Duration) ([]byte, error) {
+	payload, err := s.Marshal(dest)
+	if err != nil {
+		return nil, err
+	}
+	return sealEnvelope(envelopeVersion, s.ID(), 0, payload, compressThreshold, meta, ttl)
+}
+
+// sealEnvelope wraps an encoded payload in the header of version
+func sealEnvelope(version, serializer, flags byte, payload []byte, compressThreshold int, meta *EntryMeta, ttl time.Duration) ([]byte, error) {
+	var err error
+	if compressThreshold > 0 && len(payload) > compressThreshold {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err = zw.Close(); err != nil {
+			return nil, err
+		}
+		payload, flags = buf.Bytes(), flags|flagGzip
+	}
+	var metaJSON []byte
+	if meta != nil {
+		if metaJSON, err = json.Marshal(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+	data := make([]byte, envelopeHeaderLen, envelopeHeaderLen+len(metaJSON)+len(payload))
+	copy(data, envelopeMagic[:])
+	data[4] = version
+	data[5] = serializer
+	data[6] = flags
+	binary.BigEndian.PutUint64(data[7:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(data[15:], uint64(expires))
+	binary.BigEndian.PutUint32(data[23:], uint32(len(metaJSON)))
+	data = append(data, metaJSON...)
+	return append(data, payload...), nil
+}
+
+// decodeEnvelope decodes an entry starting with the envelope magic
+func decodeEnvelope(data []byte) (*storedEntry, error) {
+	if len(data) <= len(envelopeMagic) {
+		return nil, ErrBadEnvelope
+	}
+	switch version := data[4]; version {
+	case 1, 2:
+		return decodeEnvelopeV1(data)
+	default:
+		return nil, fmt.Errorf("%w: unknown version %d", ErrBadEnvelope, version)
+	}
+}
+
+// decodeEnvelopeV1 decodes the layout shared by versions 1 and 2
+func decodeEnvelopeV1(data []byte) (*storedEntry, error) {
+	if len(data) < envelopeHeaderLen {
+		return nil, ErrBadEnvelope
+	}
+	value, ok := serializers.Load(data[5])
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown serializer %d", ErrBadEnvelope, data[5])
+	}
+	entry := &storedEntry{
+		Version:    int(data[4]),
+		Serializer: value.(Serializer),
+		Compressed: data[6]&flagGzip != 0,
+		Columns:    data[4] >= 2 && data[6]&flagColumns != 0,
+		CreatedAt:  time.Unix(0, int64(binary.BigEndian.Uint64(data[7:]))),
+	}
+	if expires := int64(binary.BigEndian.Uint64(data[15:])); expires != 0 {
+		entry.ExpiresAt = time.Unix(0, expires)
+	}
+
+	n := int(binary.BigEndian.Uint32(data[23:]))
+	if len(data) < envelopeHeaderLen+n {
+		return nil, ErrBadEnvelope
+	}
+	if n > 0 {
+		entry.Meta = &EntryMeta{}
+		if err := json.Unmarshal(data[envelopeHeaderLen:envelopeHeaderLen+n], entry.Meta); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+		}
+	}
+
+	entry.Payload = data[envelopeHeaderLen+n:]
+	if entry.Compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(entry.Payload))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+		}
+		if entry.Payload, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// idSerializer is JSON under another ID, to check the ID round trip
+type idSerializer struct{ gormcache.JSONSerializer }
+
+func (idSerializer) ID() uint8 { return 42 }
+
+func findUsers(t *testing.T, db *gorm.DB) []testUser {
+	t.Helper()
+	var users []testUser
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Order("id").Find(&users).Error)
+	return users
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("envelope_cache", client, gormcache.CacheConfig{TTL: time.Minute, Envelope: true, Metadata: true})
+	require.NoError(t, db.Use(cache))
+
+	want := []testUser{{ID: 1, Name: "user1"}, {ID: 2, Name: "user2"}}
+	assert.Equal(t, want, findUsers(t, db))
+
+	key := onlyKey(t, client)
+	raw, err := client.Get(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xC4, 'G', 'C', 'E', 1, 1}, raw.([]byte)[:6], "magic, version and serializer")
+
+	info, err := cache.Lookup(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Version)
+	assert.Equal(t, uint8(1), info.Serializer)
+	assert.False(t, info.Compressed)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), info.ExpiresAt, 5*time.Second)
+	require.NotNil(t, info.Meta, "metadata travels in the header")
+	assert.Equal(t, []string{"test_users"}, info.Meta.Tables)
+	assert.JSONEq(t, `[{"ID":1,"Name":"user1"},{"ID":2,"Name":"user2"}]`, string(info.Value))
+
+	assert.Equal(t, want, findUsers(t, db))
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+}
+
+func TestEnvelopeCompression(t *testing.T) {
+	db := newTestDB(t, 50)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("gzip_cache", client, gormcache.CacheConfig{TTL: time.Minute, Envelope: true, CompressThreshold: 64})
+	require.NoError(t, db.Use(cache))
+
+	want := findUsers(t, db)
+	require.Len(t, want, 50)
+
+	info, err := cache.Lookup(context.Background(), onlyKey(t, client))
+	require.NoError(t, err)
+	assert.True(t, info.Compressed)
+	assert.Less(t, info.Size, len(info.Value), "stored entry is smaller than the payload")
+	assert.Nil(t, info.Meta)
+
+	assert.Equal(t, want, findUsers(t, db))
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+}
+
+func TestEnvelopeSerializer(t *testing.T) {
+	db := newTestDB(t, 1)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("serializer_cache", client, gormcache.CacheConfig{TTL: time.Minute, Envelope: true, Serializer: idSerializer{}})
+	require.NoError(t, db.Use(cache))
+
+	findUsers(t, db)
+	info, err := cache.Lookup(context.Background(), onlyKey(t, client))
+	require.NoError(t, err)
+	assert.Equal(t, uint8(42), info.Serializer)
+
+	assert.Equal(t, []testUser{{ID: 1, Name: "user1"}}, findUsers(t, db))
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+}
+
+func TestEnvelopeReadsLegacyJSON(t *testing.T) {
+	for _, metadata := range []bool{false, true} {
+		db := newTestDB(t, 2)
+		client := gormcache.NewMemoryClient()
+		legacy := gormcache.NewGormCache("legacy_cache", client, gormcache.CacheConfig{TTL: time.Minute, Metadata: metadata})
+		require.NoError(t, db.Use(legacy))
+		want := findUsers(t, db)
+
+		// a replica with the envelope turned on reads the header-less entry
+		cache := gormcache.NewGormCache("envelope_cache", client, gormcache.CacheConfig{TTL: time.Minute, Envelope: true})
+		require.NoError(t, db.Use(cache))
+		assert.Equal(t, want, findUsers(t, db))
+		assert.Equal(t, uint64(1), cache.Stats().Hits)
+
+		info, err := cache.Lookup(context.Background(), onlyKey(t, client))
+		require.NoError(t, err)
+		assert.Equal(t, 0, info.Version)
+		assert.Equal(t, metadata, info.Meta != nil)
+	}
+}
+
+func TestEnvelopeUnknownVersion(t *testing.T) {
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("version_cache", client, gormcache.CacheConfig{Envelope: true})
+	require.NoError(t, client.Set(context.Background(), "k", []byte{0xC4, 'G', 'C', 'E', 99, 1, 0}, 0))
+
+	_, err := cache.Lookup(context.Background(), "k")
+	assert.ErrorIs(t, err, gormcache.ErrBadEnvelope)
+	assert.True(t, strings.Contains(err.Error(), "version 99"), err.Error())
+}
+
+func TestEnvelopeExpiry(t *testing.T) {
+	db := newTestDB(t, 1)
+	client := newMockCacheClient() // keeps entries regardless of their ttl
+	cache := gormcache.NewGormCache("expiry_cache", client, gormcache.CacheConfig{TTL: 10 * time.Millisecond, Envelope: true})
+	require.NoError(t, db.Use(cache))
+
+	findUsers(t, db)
+	findUsers(t, db)
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []testUser{{ID: 1, Name: "user1"}}, findUsers(t, db))
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits, "expired entry is a miss")
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Sets)
+}
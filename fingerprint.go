@@ -0,0 +1,98 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// fingerprints memoizes typeFingerprint, types never change at runtime
+var fingerprints sync.Map // reflect.Type -> string
+
+// schemaFingerprint returns a hash of the model schema and of the
+// destination type of a query, so that changing either changes the key
+func schemaFingerprint(db *gorm.DB) string {
+	h := sha256.New()
+	if s := db.Statement.Schema; s != nil {
+		writeSchema(h, s)
+	}
+	if db.Statement.Dest != nil {
+		io.WriteString(h, typeFingerprint(reflect.TypeOf(db.Statement.Dest)))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// modelFingerprint returns a hash of the model schema and of the model
+// type, the destination of entity lookups
+func modelFingerprint(s *schema.Schema) string {
+	h := sha256.New()
+	writeSchema(h, s)
+	io.WriteString(h, typeFingerprint(s.ModelType))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// writeSchema writes the fields of a parsed schema
+func writeSchema(w io.Writer, s *schema.Schema) {
+	fmt.Fprintf(w, "schema %s %s\n", s.Name, s.Table)
+	for _, f := range s.Fields {
+		fmt.Fprintf(w, "%s %s %s %s\n", f.Name, f.DBName, f.FieldType, f.DataType)
+	}
+}
+
+// typeFingerprint returns a description of t covering the names, types
+// and tags of its struct fields, nested structs included
+func typeFingerprint(t reflect.Type) string {
+	if fp, ok := fingerprints.Load(t); ok {
+		return fp.(string)
+	}
+	h := sha256.New()
+	writeType(h, t, map[reflect.Type]bool{})
+	fp := hex.EncodeToString(h.Sum(nil))
+	fingerprints.Store(t, fp)
+	return fp
+}
+
+func writeType(w io.Writer, t reflect.Type, seen map[reflect.Type]bool) {
+	fmt.Fprintf(w, "%s;", t)
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		writeType(w, t.Elem(), seen)
+	case reflect.Map:
+		writeType(w, t.Key(), seen)
+		writeType(w, t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return // recursive type
+		}
+		seen[t] = true
+		fmt.Fprint(w, "{")
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fmt.Fprintf(w, "%s %q ", f.Name, f.Tag)
+			writeType(w, f.Type, seen)
+		}
+		fmt.Fprint(w, "}")
+	}
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// userV2 is testUser after a deploy renamed one of its fields.
+type userV2 struct {
+	ID       int
+	FullName string `gorm:"column:name"`
+}
+
+func (userV2) TableName() string { return "test_users" }
+
+func TestSchemaFingerprint(t *testing.T) {
+	for _, fingerprint := range []bool{false, true} {
+		db := newTestDB(t, 1)
+		require.NoError(t, db.Use(gormcache.NewGormCache("fp_cache", newMockCacheClient(), gormcache.CacheConfig{
+			TTL:               time.Minute,
+			SchemaFingerprint: fingerprint,
+		})))
+
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&[]testUser{}).Error)
+
+		var users []userV2
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&users).Error)
+		require.Len(t, users, 1)
+		if fingerprint {
+			assert.Equal(t, "user1", users[0].FullName, "the new struct gets its own entry")
+		} else {
+			assert.Empty(t, users[0].FullName, "the old entry decodes silently")
+		}
+	}
+}
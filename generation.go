@@ -0,0 +1,164 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrIncrNotSupported is returned when generation namespaces are enabled
+// but the cache client cannot increment counters
+var ErrIncrNotSupported = errors.New("gormcache: cache client does not implement Incrementer")
+
+// generationKey returns the backend key holding the generation of a table
+func (g *GormCache) generationKey(table string) string {
+	return g.config.Prefix + "gen:" + table
+}
+
+// generation reads the current generation of a table, seeding it when
+// the backend has none
+func (g *GormCache) generation(ctx context.Context, table string) (int64, error) {
+	value, err := g.client.Get(ctx, g.generationKey(table))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return g.seedGeneration(ctx, table)
+	}
+	data, ok := value.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("gormcache: unexpected generation value %T", value)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// seedGeneration starts the generation of a table at the current time in
+// nanoseconds rather than 0, so a counter evicted from the backend, e.g. by
+// memcached, restarts past every value it held and keys built before the
+// eviction are not valid again
+func (g *GormCache) seedGeneration(ctx context.Context, table string) (int64, error) {
+	gen := time.Now().UnixNano()
+	return gen, g.client.Set(ctx, g.generationKey(table), storable([]byte(strconv.FormatInt(gen, 10))), 0)
+}
+
+// namespace returns the generations of the given tables as "table=gen"
+// pairs, to be mixed into the cache key
+func (g *GormCache) namespace(ctx context.Context, tables []string) (string, error) {
+	pairs := make([]string, 0, len(tables))
+	for _, table := range tables {
+		gen, err := g.generation(ctx, table)
+		if err != nil {
+			return "", err
+		}
+		pairs = append(pairs, table+"="+strconv.FormatInt(gen, 10))
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+// InvalidateTables bumps the generation of each table, so every cached
+// query touching one of them misses from now on. Old entries are never
+// read again and age out on their TTL.
+func (g *GormCache) InvalidateTables(ctx context.Context, tables ...string) error {
+	incr, ok := g.client.(Incrementer)
+	if !ok {
+		return ErrIncrNotSupported
+	}
+	for _, table := range tables {
+		n, err := incr.Incr(ctx, g.generationKey(table))
+		if err == nil && n == 1 { // the counter was missing
+			_, err = g.seedGeneration(ctx, table)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidateCallback bumps the generation of the table written by a
+// create, update or delete statement
+func (g *GormCache) invalidateCallback(db *gorm.DB) {
+	if db.Error != nil || db.DryRun || db.Statement.Table == "" {
+		return
+	}
+	if tx := g.bufferedTxOf(db); tx != nil {
+		ctx, table := context.WithoutCancel(db.Statement.Context), db.Statement.Table
+		tx.buffer(func() {
+			if err := g.InvalidateTables(ctx, table); err != nil {
+				log.Printf("*** invalidate table %v failed: %v", table, err)
+			}
+		})
+		return
+	}
+	if err := g.InvalidateTables(db.Statement.Context, db.Statement.Table); err != nil {
+		log.Printf("*** invalidate table %v failed: %v", db.Statement.Table, err)
+	}
+}
+
+// registerInvalidation registers invalidateCallback after every write.
+// Raw and Exec do not run these callbacks, so their writes need
+// InvalidateTables.
+func (g *GormCache) registerInvalidation(db *gorm.DB) error {
+	if _, ok := g.client.(Incrementer); !ok {
+		return ErrIncrNotSupported
+	}
+	if err := db.Callback().Create().After("gorm:create").Register("gormcache:invalidate", g.invalidateCallback); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:update").Register("gormcache:invalidate", g.invalidateCallback); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("gormcache:invalidate", g.invalidateCallback)
+}
+
+// queryTables returns the sorted tables read by a query: the statement
+// table plus the tables of joined associations, and of preloaded ones when
+// they are cached with it
+func queryTables(db *gorm.DB) []string {
+	seen := map[string]struct{}{}
+	if db.Statement.Table != "" {
+		seen[db.Statement.Table] = struct{}{}
+	}
+	if graph := graphOf(db); graph != nil {
+		for _, table := range graph.tables {
+			seen[table] = struct{}{}
+		}
+	}
+	if db.Statement.Schema != nil {
+		for _, join := range db.Statement.Joins {
+			if rel, ok := db.Statement.Schema.Relationships.Relations[join.Name]; ok {
+				seen[rel.FieldSchema.Table] = struct{}{}
+			}
+		}
+	}
+
+	tables := make([]string, 0, len(seen))
+	for table := range seen {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// noIncrClient is a CacheClient without counter support.
+type noIncrClient struct{}
+
+func (noIncrClient) Get(context.Context, string) (interface{}, error)              { return nil, nil }
+func (noIncrClient) Set(context.Context, string, interface{}, time.Duration) error { return nil }
+
+func TestGenerationsRequireIncrementer(t *testing.T) {
+	db := newTestDB(t, 0)
+	cache := gormcache.NewGormCache("gen_cache", noIncrClient{}, gormcache.CacheConfig{Generations: true})
+	assert.ErrorIs(t, db.Use(cache), gormcache.ErrIncrNotSupported)
+}
+
+func TestGenerationsInvalidateOnWrite(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("gen_cache", client, gormcache.CacheConfig{
+		TTL:         time.Minute,
+		Prefix:      "gen:",
+		Generations: true,
+	})
+	require.NoError(t, db.Use(cache))
+
+	find := func() []testUser {
+		var users []testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Order("id").Find(&users).Error)
+		return users
+	}
+
+	assert.Len(t, find(), 3)
+	sets := client.sets
+	assert.Len(t, find(), 3)
+	assert.Equal(t, sets, client.sets, "second read must be served from cache")
+
+	// the write bumps the generation of the users table
+	require.NoError(t, db.Create(&testUser{ID: 4, Name: "user4"}).Error)
+	assert.Len(t, find(), 4)
+
+	require.NoError(t, db.Where("id = ?", 1).Delete(&testUser{}).Error)
+	assert.Len(t, find(), 3)
+}
+
+func TestInvalidateTables(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("gen_cache", client, gormcache.CacheConfig{
+		TTL:         time.Minute,
+		Prefix:      "gen:",
+		Generations: true,
+	})
+	require.NoError(t, db.Use(cache))
+
+	var users []testUser
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&users).Error)
+
+	// a change made behind GORM's back is only seen after invalidating
+	require.NoError(t, db.Exec("UPDATE test_users SET name = ?", "changed").Error)
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&users).Error)
+	assert.Equal(t, "user1", users[0].Name)
+
+	require.NoError(t, cache.InvalidateTables(context.Background(), "test_users"))
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&users).Error)
+	assert.Equal(t, "changed", users[0].Name)
+}
+
+func TestGenerationSeededAfterEviction(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("gen_cache", client, gormcache.CacheConfig{
+		TTL:         time.Minute,
+		Prefix:      "gen:",
+		Generations: true,
+	})
+	require.NoError(t, db.Use(cache))
+	find := func() {
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&[]testUser{}).Error)
+	}
+
+	// the entries of a first generation, then of a second one
+	find()
+	genKey := "gen:gen:test_users"
+	first := string(client.store[genKey])
+	require.NoError(t, cache.InvalidateTables(context.Background(), "test_users"))
+	find()
+	assert.Equal(t, gormcache.Stats{Misses: 2, Sets: 2}, cache.Stats())
+
+	// an evicted counter restarts past both, from a read or a write
+	delete(client.store, genKey)
+	find()
+	assert.Equal(t, gormcache.Stats{Misses: 3, Sets: 3}, cache.Stats())
+	assert.Greater(t, string(client.store[genKey]), first)
+
+	delete(client.store, genKey)
+	require.NoError(t, cache.InvalidateTables(context.Background(), "test_users"))
+	assert.Greater(t, string(client.store[genKey]), first)
+	find()
+	assert.Equal(t, gormcache.Stats{Misses: 4, Sets: 4}, cache.Stats())
+}
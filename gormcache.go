@@ -20,9 +20,9 @@ package gormcache
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log"
-	"reflect"
+	"sync/atomic"
 	"time"
 
 	"gorm.io/gorm/callbacks"
@@ -30,12 +30,22 @@ import (
 	"gorm.io/gorm"
 )
 
+// distinct key types, so the keys do not collide when stored in a context
+type (
+	useCacheKey struct{}
+	cacheTTLKey struct{}
+)
+
 var (
-	UseCacheKey struct{}
-	CacheTTLKey struct{}
+	UseCacheKey useCacheKey
+	CacheTTLKey cacheTTLKey
 )
 
-// CacheClient is an interface for cache operations
+// CacheClient is an interface for cache operations. Set receives JSON
+// entries as a json.RawMessage, so clients encoding values with
+// json.Marshal store them as before, and the binary entries of Envelope,
+// Columns and Row/Rows queries as []byte, to be stored verbatim. Get
+// returns the stored bytes as []byte.
 type CacheClient interface {
 	Get(ctx context.Context, key string) (interface{}, error)
 	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
@@ -43,23 +53,74 @@ type CacheClient interface {
 
 // CacheConfig is a struct for cache options
 type CacheConfig struct {
-	TTL    time.Duration // cache expiration time
-	Prefix string        // cache key prefix
+	TTL         time.Duration // cache expiration time
+	Prefix      string        // cache key prefix
+	Generations bool          // namespace keys by per-table generation counters
+
+	KeyGenerator KeyGenerator // builds the keys of queries, HashKeyGenerator by default
+
+	SchemaFingerprint bool // mix the model schema and destination type into keys
+
+	WarmConcurrency int // maximum number of queries run at once by Warm
+
+	RefreshAhead     float64 // refresh entries read within this fraction of the end of their TTL
+	RefreshAheadHits int     // minimum number of reads before an entry is refreshed ahead
+
+	TTLJitter        time.Duration  // randomize each TTL by up to this duration either way
+	TTLJitterPercent float64        // randomize each TTL by up to this percentage either way
+	Rand             func() float64 // jitter source returning values in [0, 1), math/rand/v2 by default
+
+	TxPolicy TxPolicy // cache behaviour inside transactions, TxBypass by default
+
+	SessionWindow time.Duration // bypass cached reads of tables the session wrote within this window
+	SessionStore  SessionStore  // where session writes are tracked, in process memory by default
+
+	Local       CacheClient   // optional in-process layer in front of the client, e.g. a MemoryClient
+	LocalTTL    time.Duration // cap on the ttl of local entries, which never outlive the client's
+	Broadcaster Broadcaster   // publishes local evictions to the other processes
+
+	Metadata  bool // store the originating SQL and other metadata with each entry
+	RedactSQL bool // store the SQL with placeholders instead of the bound values
+
+	Envelope          bool       // store entries in the versioned binary envelope
+	Serializer        Serializer // payload encoding inside the envelope, JSON by default
+	CompressThreshold int        // gzip envelope payloads larger than this many bytes, 0 disables
+	Columns           bool       // store scanned column values and replay them on hits, preserving field types
+
+	MaxEntryBytes int   // do not cache entries larger than this many bytes once encoded, 0 for no limit
+	MaxRows       int64 // do not cache results with more rows than this, 0 for no limit
+
+	Adaptive          bool          // time queries and cache those without UseCacheKey once they are slow
+	AdaptiveThreshold time.Duration // average latency from which Adaptive caches a query, 10ms by default
+
+	Entities       bool // cache primary-key lookups by model and key, whatever their SQL
+	NormalizeLists bool // cache lists of models as their primary keys, rows as entities
+	Preloads       bool // cache queries with Preload as one entry holding the preloaded associations
 }
 
 // GormCache is a cache plugin for gorm
 type GormCache struct {
-	name   string
-	client CacheClient
-	config CacheConfig
+	name      string
+	client    CacheClient
+	config    CacheConfig
+	db        *gorm.DB
+	refresher *refresher
+	latency   *latencyTracker
+	counters  counters
+	disabled  atomic.Bool
 }
 
 // NewGormCache returns a new GormCache instance
 func NewGormCache(name string, client CacheClient, config CacheConfig) *GormCache {
+	if config.Serializer != nil {
+		RegisterSerializer(config.Serializer)
+	}
 	return &GormCache{
-		name:   name,
-		client: client,
-		config: config,
+		name:      name,
+		client:    client,
+		config:    config,
+		refresher: newRefresher(),
+		latency:   newLatencyTracker(),
 	}
 }
 
@@ -70,6 +131,41 @@ func (g *GormCache) Name() string {
 
 // Initialize initializes the plugin
 func (g *GormCache) Initialize(db *gorm.DB) error {
+	if _, ok := g.keyGenerator().(KeyScoper); !ok && (g.config.Entities || g.config.NormalizeLists) {
+		return ErrNoKeyScope // entity keys could not follow the scope of the generator
+	}
+	g.db = db
+	if g.config.TxPolicy == TxBuffer || g.config.Entities {
+		wrapTxPool(db) // entities are dropped again once a transaction commits
+	}
+	if g.config.Generations {
+		if err := g.registerInvalidation(db); err != nil {
+			return err
+		}
+	}
+	if g.config.SessionWindow > 0 {
+		if err := g.registerSessions(db); err != nil {
+			return err
+		}
+	}
+	if g.config.Local != nil {
+		if err := g.registerLocal(db); err != nil {
+			return err
+		}
+	}
+	if g.config.Entities || g.config.NormalizeLists {
+		if err := g.registerEntities(db); err != nil {
+			return err
+		}
+	}
+	if g.config.Preloads {
+		if err := db.Callback().Query().Replace("gorm:preload", g.preloadCallback); err != nil {
+			return err
+		}
+	}
+	if err := db.Callback().Row().Replace("gorm:row", g.rowCallback); err != nil {
+		return err
+	}
 	return db.Callback().Query().Replace("gorm:query", g.queryCallback)
 }
 
@@ -79,7 +175,7 @@ func (g *GormCache) queryCallback(db *gorm.DB) {
 		return
 	}
 
-	enableCache := g.enableCache(db)
+	enableCache, adaptive := g.enableCache(db)
 
 	// build query sql
 	callbacks.BuildQuerySQL(db)
@@ -87,66 +183,137 @@ func (g *GormCache) queryCallback(db *gorm.DB) {
 		return
 	}
 
+	// queries left to the adaptive mode are cached once they proved slow
+	fingerprint := db.Statement.SQL.String()
+	if adaptive {
+		enableCache = g.latency.slow(fingerprint, g.adaptiveThreshold())
+	}
+
+	// a query with preloads is cached as a whole graph, stored by
+	// preloadCallback once the associations are loaded
+	var graph *graphQuery
+	if enableCache && g.config.Preloads {
+		graph = newGraph(db)
+	}
+	if g.config.Preloads {
+		db.InstanceSet(graphKey, graph) // the statement may run again
+	}
+
 	var (
-		key string
-		err error
-		hit bool
+		key    string
+		err    error
+		hit    bool
+		entity bool
+		list   bool
 	)
-	if enableCache {
-		key = g.cacheKey(db)
+	if enableCache && g.config.Entities && graph == nil {
+		key, entity = g.entityLookup(db)
+	}
+	if enableCache && key == "" {
+		key, err = g.cacheKey(db)
+		if err != nil {
+			log.Printf("*** build cache key failed, err: '%v'", err)
+			enableCache = false
+		} else if g.config.NormalizeLists && graph == nil && listQuery(db) {
+			if prefix, err := g.keyPrefix(db); err == nil {
+				key, list = listKey(prefix, key), true
+			}
+		}
+	}
 
+	// inside a transaction the cache may hold rows the transaction changed,
+	// and a session must see its own recent writes
+	if enableCache && !refreshing(db) && !inTransaction(db) && !g.sessionWrote(db) {
 		// get value from cache
-		hit, err = g.loadCache(db, key)
+		if list {
+			hit, err = g.loadList(db, key)
+		} else {
+			hit, err = g.loadCache(db, key)
+		}
 		if err != nil {
+			// an unreadable entry is a miss, the query overwrites it
+			g.counters.errors.Add(1)
 			log.Printf("*** load cache failed, err: '%v', hit value: %v", err, hit)
-			return
+			hit = false
 		}
 
 		// hit cache
 		if hit {
+			if graph != nil {
+				graph.hit = true
+			}
+			g.counters.hits.Add(1)
+			if g.config.Adaptive {
+				g.latency.hit(fingerprint)
+			}
+			g.refreshAhead(key)
 			return
 		}
 
 		// cache miss, continue database operation
+		g.counters.misses.Add(1)
 		//log.Printf("------------------------- miss cache, key: %v", key)
 	}
 
 	if !hit {
-		g.queryDB(db)
+		start := time.Now()
+		record := g.config.Columns || isScalar(db.Statement.ReflectValue)
+		g.queryDB(db, enableCache && record && !entity && !list && graph == nil)
+		if g.config.Adaptive && db.Error == nil {
+			g.latency.observe(fingerprint, time.Since(start))
+		}
 
-		if enableCache {
-			if err = g.setCache(db, key); err != nil {
+		// failed queries are not cached, and neither are missing entities,
+		// they may be created any time
+		if enableCache && cacheable(db) && !(entity && db.RowsAffected == 0) {
+			if graph != nil {
+				graph.key = key
+			} else if list {
+				err = g.setList(db, key)
+			} else if tx := g.bufferedTxOf(db); tx != nil {
+				err = g.bufferSet(tx, db, key)
+			} else {
+				err = g.setCache(db, key)
+			}
+			if err != nil {
+				g.counters.errors.Add(1)
 				log.Printf("*** set cache failed: %v", err)
 			}
 		}
 	}
 }
 
-func (g *GormCache) enableCache(db *gorm.DB) bool {
+// enableCache reports whether the query may use the cache, and whether
+// that is left to the adaptive mode because the context does not say
+func (g *GormCache) enableCache(db *gorm.DB) (enable, adaptive bool) {
 	ctx := db.Statement.Context
+	if g.disabled.Load() {
+		return false, false // caching turned off globally
+	}
+	if inTransaction(db) && g.bufferedTxOf(db) == nil {
+		return false, false // uncommitted data must not reach the shared cache
+	}
 
-	// check if use cache
-	useCache, ok := ctx.Value(UseCacheKey).(bool)
-	if !ok || !useCache {
-		return false // do not use cache, skip this callback
+	// a model may be never cached, or cached without context values, and
+	// its rows must not reach the cache joined to another's either
+	policy := policyOf(db.Statement.Schema)
+	if policy != nil && !policy.CacheEnabled() || joinsNeverCached(db.Statement) {
+		return false, false
 	}
-	return true
-}
 
-func isArrayOrSlice(m reflect.Value) bool {
-	rt := reflect.TypeOf(m)
-	switch rt.Kind() {
-	case reflect.Slice:
-		return true
-	case reflect.Array:
-		return true
-	default:
-		return false
+	// check if use cache
+	useCache, ok := ctx.Value(UseCacheKey).(bool)
+	if !ok {
+		if policy != nil {
+			return true, false
+		}
+		return false, g.config.Adaptive
 	}
+	return useCache, false // false means do not use cache, skip this callback
 }
 
 func (g *GormCache) loadCache(db *gorm.DB, key string) (bool, error) {
-	value, err := g.client.Get(db.Statement.Context, key)
+	value, err := g.get(db, key)
 	if err != nil {
 		return false, err
 	}
@@ -155,34 +322,102 @@ func (g *GormCache) loadCache(db *gorm.DB, key string) (bool, error) {
 		return false, nil
 	}
 
-	// cache hit, scan value to destination
-	if err = json.Unmarshal(value.([]byte), &db.Statement.Dest); err != nil {
+	entry, err := decodeEntry(value.([]byte))
+	if err != nil {
 		return false, err
 	}
-	if isArrayOrSlice(db.Statement.ReflectValue) {
-		db.RowsAffected = int64(db.Statement.ReflectValue.Len())
-	} else {
-		db.RowsAffected = int64(1)
+	if entry.expired(time.Now()) {
+		return false, nil // backends without native TTL keep expired entries
+	}
+
+	// recorded columns go through the scanner like database rows do
+	if entry.Columns {
+		rs, err := decodeColumns(entry)
+		if err != nil {
+			return false, err
+		}
+		replay(db, rs)
+		return true, nil
+	}
+
+	// a single record that was not found leaves the destination as is,
+	// like the database path does
+	if entry.notFound() {
+		db.RowsAffected = 0
+		if db.Statement.RaiseErrorOnNotFound {
+			db.AddError(gorm.ErrRecordNotFound)
+		}
+		return true, nil
 	}
 
+	// cache hit, decode into the concrete destination
+	rows, err := decodeResult(entry.Serializer, entry.Payload, db.Statement.ReflectValue)
+	if err != nil {
+		return false, err
+	}
+	db.RowsAffected = rows
 	return true, nil
 }
 
+// ttl returns the jittered cache ttl from context, model or config
+func (g *GormCache) ttl(db *gorm.DB) time.Duration {
+	ttl, ok := db.Statement.Context.Value(CacheTTLKey).(time.Duration)
+	if !ok {
+		ttl = g.modelTTL(db.Statement.Schema) // use default ttl
+	}
+	return g.jitter(ttl)
+}
+
 func (g *GormCache) setCache(db *gorm.DB, key string) error {
 	ctx := db.Statement.Context
+	ttl := g.ttl(db)
+	//log.Printf("ttl: %v", ttl)
 
-	// get cache ttl from context or config
-	ttl, ok := ctx.Value(CacheTTLKey).(time.Duration)
-	if !ok {
-		ttl = g.config.TTL // use default ttl
+	if g.tooManyRows(key, db.RowsAffected) {
+		return nil
 	}
-	//log.Printf("ttl: %v", ttl)
 
 	// set value to cache with ttl
-	return g.client.Set(ctx, key, db.Statement.Dest, ttl)
+	payload, err := g.payload(db, ttl)
+	if err != nil {
+		return err
+	}
+	if g.tooLarge(key, payload) {
+		return nil
+	}
+	if err = g.store(ctx, key, payload, entryTags(db), ttl); err != nil {
+		return err
+	}
+	if g.config.Adaptive {
+		g.latency.stored(db.Statement.SQL.String(), len(payload))
+	}
+	if g.config.RefreshAhead > 0 && graphOf(db) == nil { // a refresh would drop the associations
+		g.refresher.record(key, db, ttl)
+	}
+	return nil
 }
 
-func (g *GormCache) queryDB(db *gorm.DB) {
+// store writes an encoded entry to the client, counts it, tags it and
+// copies it to the local layer
+func (g *GormCache) store(ctx context.Context, key string, payload []byte, tags []string, ttl time.Duration) error {
+	if err := g.client.Set(ctx, key, storable(payload), ttl); err != nil {
+		return err
+	}
+	g.counters.sets.Add(1)
+	g.tag(ctx, key, tags, ttl)
+	g.setLocal(ctx, key, payload, tags, ttl)
+	return nil
+}
+
+// cacheable reports whether the outcome of a query may be stored: it
+// succeeded, or found no record for a single-record finder
+func cacheable(db *gorm.DB) bool {
+	return db.Error == nil || errors.Is(db.Error, gorm.ErrRecordNotFound)
+}
+
+// queryDB runs the query and scans its rows. With record set the rows
+// are first read as column values, kept for setCache, and replayed.
+func (g *GormCache) queryDB(db *gorm.DB, record bool) {
 	rows, err := db.Statement.ConnPool.QueryContext(db.Statement.Context, db.Statement.SQL.String(), db.Statement.Vars...)
 	if err != nil {
 		db.AddError(err)
@@ -191,5 +426,16 @@ func (g *GormCache) queryDB(db *gorm.DB) {
 	defer func() {
 		db.AddError(rows.Close())
 	}()
-	gorm.Scan(rows, db, 0)
+	if !record {
+		db.InstanceSet(columnsKey, (*resultSet)(nil)) // the statement may run again
+		gorm.Scan(rows, db, 0)
+		return
+	}
+	rs, err := readResultSet(rows)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	replay(db, rs)
+	db.InstanceSet(columnsKey, rs)
 }
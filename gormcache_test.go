@@ -20,25 +20,35 @@ package gormcache_test
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/stretchr/testify/assert"
+	"github.com/glebarez/sqlite"
 	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 )
 
 // mockCacheClient is an in-memory CacheClient for unit testing.
 type mockCacheClient struct {
+	mu    sync.Mutex
 	store map[string][]byte
+	ttls  map[string]time.Duration
 	gets  int
 	sets  int
 }
 
 func newMockCacheClient() *mockCacheClient {
-	return &mockCacheClient{store: make(map[string][]byte)}
+	return &mockCacheClient{store: make(map[string][]byte), ttls: make(map[string]time.Duration)}
 }
 
 func (m *mockCacheClient) Get(_ context.Context, key string) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.gets++
 	v, ok := m.store[key]
 	if !ok {
@@ -47,15 +57,61 @@ func (m *mockCacheClient) Get(_ context.Context, key string) (interface{}, error
 	return v, nil
 }
 
-func (m *mockCacheClient) Set(_ context.Context, key string, value interface{}, _ time.Duration) error {
+func (m *mockCacheClient) Set(_ context.Context, key string, value interface{}, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.sets++
+	m.ttls[key] = ttl
 	if b, ok := value.([]byte); ok {
 		m.store[key] = b
 		return nil
 	}
+	// encode like the real backends do
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	m.store[key] = b
 	return nil
 }
 
+func (m *mockCacheClient) Incr(_ context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _ := strconv.ParseInt(string(m.store[key]), 10, 64)
+	n++
+	m.store[key] = []byte(strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+// testUser is the model used by the sqlite backed tests.
+type testUser struct {
+	ID   int
+	Name string
+}
+
+// newTestDB opens an in-memory sqlite database seeded with count users.
+func newTestDB(t *testing.T, count int) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1) // every connection would get its own memory database
+	t.Cleanup(func() { sqlDB.Close() })
+
+	require.NoError(t, db.AutoMigrate(&testUser{}))
+	for i := 1; i <= count; i++ {
+		require.NoError(t, db.Create(&testUser{ID: i, Name: "user" + strconv.Itoa(i)}).Error)
+	}
+	return db
+}
+
+// cacheCtx returns a context enabling the cache.
+func cacheCtx() context.Context {
+	return context.WithValue(context.Background(), gormcache.UseCacheKey, true)
+}
+
 func TestNewGormCache(t *testing.T) {
 	client := newMockCacheClient()
 	config := gormcache.CacheConfig{TTL: 30 * time.Second, Prefix: "test:"}
@@ -84,3 +140,48 @@ func TestContextKeys(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, 5*time.Second, ttl)
 }
+
+func TestContextKeysDistinct(t *testing.T) {
+	ctx := context.WithValue(context.Background(), gormcache.UseCacheKey, true)
+	ctx = context.WithValue(ctx, gormcache.CacheTTLKey, 5*time.Second)
+	useCache, ok := ctx.Value(gormcache.UseCacheKey).(bool)
+	assert.True(t, ok)
+	assert.True(t, useCache)
+}
+
+func TestTTLJitter(t *testing.T) {
+	args := []struct {
+		Name     string
+		Config   gormcache.CacheConfig
+		CtxTTL   time.Duration
+		Random   float64
+		Expected time.Duration
+	}{
+		{Name: "no jitter", Config: gormcache.CacheConfig{TTL: time.Minute}, Random: 0, Expected: time.Minute},
+		{Name: "fixed low", Config: gormcache.CacheConfig{TTL: time.Minute, TTLJitter: 10 * time.Second}, Random: 0, Expected: 50 * time.Second},
+		{Name: "fixed middle", Config: gormcache.CacheConfig{TTL: time.Minute, TTLJitter: 10 * time.Second}, Random: 0.5, Expected: time.Minute},
+		{Name: "percent high", Config: gormcache.CacheConfig{TTL: time.Minute, TTLJitterPercent: 10}, Random: 0.75, Expected: 63 * time.Second},
+		{Name: "context ttl", Config: gormcache.CacheConfig{TTL: time.Minute, TTLJitterPercent: 10}, CtxTTL: 10 * time.Second, Random: 0, Expected: 9 * time.Second},
+		{Name: "capped spread", Config: gormcache.CacheConfig{TTL: time.Minute, TTLJitter: time.Hour}, Random: 0, Expected: 30 * time.Second},
+	}
+
+	for _, arg := range args {
+		t.Run(arg.Name, func(t *testing.T) {
+			db := newTestDB(t, 1)
+			client := newMockCacheClient()
+			random := arg.Random
+			arg.Config.Rand = func() float64 { return random }
+			require.NoError(t, db.Use(gormcache.NewGormCache("jitter_cache", client, arg.Config)))
+
+			ctx := cacheCtx()
+			if arg.CtxTTL > 0 {
+				ctx = context.WithValue(ctx, gormcache.CacheTTLKey, arg.CtxTTL)
+			}
+			require.NoError(t, db.Session(&gorm.Session{Context: ctx}).Find(&[]testUser{}).Error)
+			require.Len(t, client.ttls, 1)
+			for _, ttl := range client.ttls {
+				assert.Equal(t, arg.Expected, ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dialecttest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// testUser is the model of the queries
+type testUser struct {
+	ID   int
+	Name string
+}
+
+// newConn opens an in-memory sqlite database holding one user and returns
+// its connection
+func newConn(t *testing.T) gorm.ConnPool {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	conn, err := db.DB()
+	require.NoError(t, err)
+	conn.SetMaxOpenConns(1) // every connection would get its own memory database
+	t.Cleanup(func() { conn.Close() })
+
+	require.NoError(t, db.AutoMigrate(&testUser{}))
+	require.NoError(t, db.Create(&testUser{ID: 1, Name: "user1"}).Error)
+	return conn
+}
+
+// cacheCtx returns a context enabling the cache
+func cacheCtx() context.Context {
+	return context.WithValue(context.Background(), gormcache.UseCacheKey, true)
+}
+
+// TestKeyCollisions runs pairs of queries the dialectors explain to the
+// same SQL, over one SQLite connection, and checks that each gets its own
+// entry
+func TestKeyCollisions(t *testing.T) {
+	at := time.Date(2023, 5, 1, 10, 30, 0, 123000000, time.UTC)
+	raw := func(sql string) func(tx *gorm.DB, v interface{}, out *string) *gorm.DB {
+		return func(tx *gorm.DB, v interface{}, out *string) *gorm.DB { return tx.Raw(sql, v).Find(out) }
+	}
+	pairs := []struct {
+		name string
+		run  func(tx *gorm.DB, v interface{}, out *string) *gorm.DB
+		a, b interface{}
+	}{
+		{"bytes and string", func(tx *gorm.DB, v interface{}, out *string) *gorm.DB {
+			return tx.Model(&testUser{}).Select("COUNT(*)").Where("name = ?", v).Find(out)
+		}, []byte("user1"), "user1"},
+		{"time below a millisecond", raw("SELECT ?"), at, at.Add(time.Microsecond)},
+		{"float32 and float64", raw("SELECT ?"), float32(0.1), 0.1},
+	}
+	dialectors := map[string]func(conn gorm.ConnPool) gorm.Dialector{
+		"sqlite": func(conn gorm.ConnPool) gorm.Dialector { return &sqlite.Dialector{Conn: conn} },
+		"mysql": func(conn gorm.ConnPool) gorm.Dialector {
+			return mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true})
+		},
+		"postgres": func(conn gorm.ConnPool) gorm.Dialector { return postgres.New(postgres.Config{Conn: conn}) },
+	}
+	for name, dialector := range dialectors {
+		t.Run(name, func(t *testing.T) {
+			db, err := gorm.Open(dialector(newConn(t)), &gorm.Config{})
+			require.NoError(t, err)
+			cache := gormcache.NewGormCache("collision_cache", gormcache.NewMemoryClient(), gormcache.CacheConfig{TTL: time.Minute})
+			require.NoError(t, db.Use(cache))
+
+			for _, p := range pairs {
+				explain := func(v interface{}) string {
+					return db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+						var out string
+						return p.run(tx, v, &out)
+					})
+				}
+				require.Equal(t, explain(p.a), explain(p.b), "%s: not a collision of the explained SQL", p.name)
+
+				find := func(ctx context.Context, v interface{}) (out string) {
+					require.NoError(t, p.run(db.WithContext(ctx), v, &out).Error)
+					return out
+				}
+				wantA, wantB := find(context.Background(), p.a), find(context.Background(), p.b)
+				require.NotEqual(t, wantA, wantB, p.name)
+				for i := 0; i < 2; i++ {
+					assert.Equal(t, wantA, find(cacheCtx(), p.a), p.name)
+					assert.Equal(t, wantB, find(cacheCtx(), p.b), p.name)
+				}
+			}
+			assert.Equal(t, uint64(2*len(pairs)), cache.Stats().Hits)
+		})
+	}
+}
@@ -0,0 +1,231 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// KeyGenerator builds the cache keys of queries
+type KeyGenerator interface {
+	// Key returns the key of the query of db, without the configured
+	// Prefix. query is the SQL and its type-tagged vars plus whatever else
+	// tells results apart, e.g. table generations or the destination type.
+	// An error leaves the query uncached.
+	Key(db *gorm.DB, query string) (string, error)
+}
+
+// KeyScoper is implemented by KeyGenerators whose keys start with scope
+// segments, e.g. a tenant. The keys the plugin builds itself, of entities
+// and of normalized lists, start with the same scope.
+type KeyScoper interface {
+	// Scope returns the segments the keys of db start with, without the
+	// separator after them, "" for none. An error leaves the query
+	// uncached.
+	Scope(db *gorm.DB) (string, error)
+}
+
+// ErrNoKeyScope is returned by Initialize when Entities or NormalizeLists
+// are set with a KeyGenerator that is not a KeyScoper
+var ErrNoKeyScope = errors.New("gormcache: Entities and NormalizeLists need a KeyGenerator implementing KeyScoper")
+
+// HashKeyGenerator is the default KeyGenerator: a hash of the query,
+// after the readable scope segments it is configured with. The zero value
+// gives the hex SHA-256 of the query.
+type HashKeyGenerator struct {
+	Hash      func() hash.Hash                  // hash function, e.g. fnv.New128a, sha256.New by default
+	Dialector bool                              // scope keys by the dialector name, e.g. "mysql"
+	Namespace func(db *gorm.DB) (string, error) // scope keys by e.g. a database name, tenant ID or app version
+	Debug     bool                              // keep the tables and the SQL fingerprint readable in the key
+}
+
+// Key implements KeyGenerator. Scope segments come first and are part of
+// the key as is, so PurgePrefix can drop the entries of one scope.
+func (k HashKeyGenerator) Key(db *gorm.DB, query string) (string, error) {
+	scope, err := k.Scope(db)
+	if err != nil {
+		return "", err
+	}
+	newHash := k.Hash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	h := newHash()
+	io.WriteString(h, query)
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	var segments []string
+	if scope != "" {
+		segments = append(segments, scope)
+	}
+	if k.Debug {
+		// the readable segments get what is left of debugKeyLen after
+		// the scope, the hash and the separators, dropped when too short
+		room := debugKeyLen - len(scope) - len(sum) - 3
+		tables := keySegment(strings.Join(queryTables(db), ","), min(64, room/2))
+		sql := keySegment(db.Statement.SQL.String(), min(64, room-len(tables)))
+		if tables != "" && sql != "" {
+			segments = append(segments, tables, sql)
+		}
+	}
+	return strings.Join(append(segments, sum), ":"), nil
+}
+
+// debugKeyLen caps the keys of HashKeyGenerator with Debug set. Memcached
+// takes keys up to 250 bytes, the rest is left for Prefix and the "ids:"
+// or "rows:" segment.
+const debugKeyLen = 200
+
+// Scope implements KeyScoper, the dialector and namespace segments
+func (k HashKeyGenerator) Scope(db *gorm.DB) (string, error) {
+	var segments []string
+	if k.Dialector {
+		segments = append(segments, keySegment(db.Dialector.Name(), 32))
+	}
+	if k.Namespace != nil {
+		ns, err := k.Namespace(db)
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, keySegment(ns, 64))
+	}
+	return strings.Join(segments, ":"), nil
+}
+
+// keySegment makes s safe inside a key on every backend, memcached
+// being the strictest: no spaces, control characters or separators, and
+// at most n bytes
+func keySegment(s string, n int) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == ':' || r <= ' ' || r == 0x7f || r > 0x7e:
+			return '_'
+		case r == '`' || r == '"' || r == '\'':
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > max(n, 0) {
+		s = s[:max(n, 0)]
+	}
+	return s
+}
+
+// keyGenerator returns the configured KeyGenerator or the default one
+func (g *GormCache) keyGenerator() KeyGenerator {
+	if g.config.KeyGenerator != nil {
+		return g.config.KeyGenerator
+	}
+	return HashKeyGenerator{}
+}
+
+// keyPrefix returns Prefix followed by the scope of the keys of db, the
+// start of the keys built outside the KeyGenerator. It is Prefix alone
+// on errors, ErrNoKeyScope when the generator is not a KeyScoper.
+func (g *GormCache) keyPrefix(db *gorm.DB) (string, error) {
+	scoper, ok := g.keyGenerator().(KeyScoper)
+	if !ok {
+		return g.config.Prefix, ErrNoKeyScope
+	}
+	scope, err := scoper.Scope(db)
+	if err != nil || scope == "" {
+		return g.config.Prefix, err
+	}
+	return g.config.Prefix + scope + ":", nil
+}
+
+// canonicalQuery returns the SQL of a statement, with its placeholders,
+// followed by a type-tagged encoding of its vars. Values the dialector
+// would explain alike, e.g. []byte and string or times differing below a
+// millisecond, encode differently.
+func canonicalQuery(db *gorm.DB) (string, error) {
+	var b strings.Builder
+	b.WriteString(db.Statement.SQL.String())
+	b.WriteByte(0)
+	for _, v := range db.Statement.Vars {
+		if err := writeVar(&b, v); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// writeVar writes v as a type tag, its length when it has one, and its
+// value. Valuers are written as the driver value they produce.
+func writeVar(b *strings.Builder, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() == reflect.Pointer && rv.IsNil() {
+		b.WriteString("n;")
+		return nil
+	}
+	switch x := v.(type) {
+	case driver.Valuer:
+		dv, err := x.Value()
+		if err != nil {
+			return err
+		}
+		return writeVar(b, dv)
+	case time.Time:
+		_, offset := x.Zone()
+		fmt.Fprintf(b, "t%d.%09d/%s/%d;", x.Unix(), x.Nanosecond(), x.Location(), offset)
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer:
+		return writeVar(b, rv.Elem().Interface())
+	case reflect.Bool:
+		fmt.Fprintf(b, "b%t;", rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(b, "i%d;", rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprintf(b, "u%d;", rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		fmt.Fprintf(b, "f%s;", strconv.FormatFloat(rv.Float(), 'g', -1, 64))
+	case reflect.String:
+		fmt.Fprintf(b, "s%d:%s;", rv.Len(), rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(data), rv)
+			fmt.Fprintf(b, "x%d:%s;", len(data), data)
+			return nil
+		}
+		fmt.Fprintf(b, "l%d[", rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			if err := writeVar(b, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		b.WriteString("];")
+	default:
+		fmt.Fprintf(b, "?%s:%#v;", rv.Type(), v)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/fnv"
+	"strings"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type tenantKey struct{}
+
+// tenantNamespace scopes keys by the tenant in the context, refusing to
+// build keys without one
+func tenantNamespace(db *gorm.DB) (string, error) {
+	tenant, ok := db.Statement.Context.Value(tenantKey{}).(string)
+	if !ok {
+		return "", errors.New("no tenant")
+	}
+	return "tenant-" + tenant, nil
+}
+
+// staticKeys maps every query to the same key
+type staticKeys struct{}
+
+func (staticKeys) Key(*gorm.DB, string) (string, error) { return "static", nil }
+
+// findWithKey runs a cached query and returns the key it was stored under
+func findWithKey(t *testing.T, config gormcache.CacheConfig, ctx context.Context) (string, *gormcache.GormCache) {
+	t.Helper()
+	db := newTestDB(t, 3)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("keys_cache", client, config)
+	require.NoError(t, db.Use(cache))
+
+	for i := 0; i < 2; i++ {
+		var users []testUser
+		require.NoError(t, db.WithContext(ctx).Where("id > ?", 1).Find(&users).Error)
+		assert.Len(t, users, 2)
+	}
+	keys := keysWith(t, client, "")
+	if len(keys) == 0 {
+		return "", cache
+	}
+	require.Len(t, keys, 1)
+	return keys[0], cache
+}
+
+func TestDefaultKey(t *testing.T) {
+	key, cache := findWithKey(t, gormcache.CacheConfig{TTL: time.Minute, Prefix: "app:"}, cacheCtx())
+	sum := sha256.Sum256([]byte("SELECT * FROM `test_users` WHERE id > ?\x00i1;"))
+	assert.Equal(t, "app:"+hex.EncodeToString(sum[:]), key)
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+}
+
+func TestHashKeyGenerator(t *testing.T) {
+	cases := []struct {
+		name string
+		gen  gormcache.HashKeyGenerator
+		ok   func(key string) bool
+	}{
+		{"fnv", gormcache.HashKeyGenerator{Hash: func() hash.Hash { return fnv.New128a() }}, func(key string) bool {
+			return len(key) == 32
+		}},
+		{"dialector", gormcache.HashKeyGenerator{Dialector: true}, func(key string) bool {
+			return strings.HasPrefix(key, "sqlite:") && len(key) == len("sqlite:")+64
+		}},
+		{"debug", gormcache.HashKeyGenerator{Debug: true}, func(key string) bool {
+			return strings.HasPrefix(key, "test_users:SELECT_*_FROM_test_users_WHERE_id_>_?:")
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			key, cache := findWithKey(t, gormcache.CacheConfig{TTL: time.Minute, KeyGenerator: c.gen}, cacheCtx())
+			assert.True(t, c.ok(key), key)
+			assert.Equal(t, uint64(1), cache.Stats().Hits)
+		})
+	}
+}
+
+func TestKeyDebugLength(t *testing.T) {
+	ns := strings.Repeat("n", 100)
+	gen := gormcache.HashKeyGenerator{Dialector: true, Debug: true, Namespace: func(*gorm.DB) (string, error) { return ns, nil }}
+	db := newTestDB(t, 3)
+	client := gormcache.NewMemoryClient()
+	require.NoError(t, db.Use(gormcache.NewGormCache("keys_cache", client, gormcache.CacheConfig{TTL: time.Minute, Prefix: "app:", KeyGenerator: gen})))
+
+	table := strings.Repeat("t", 70)
+	require.NoError(t, db.Table(table).AutoMigrate(&testUser{}))
+
+	var users []testUser
+	require.NoError(t, db.WithContext(cacheCtx()).Table(table).Where("id > ? AND name <> ?", 1, "a").Find(&users).Error)
+	key := onlyKey(t, client)
+	assert.LessOrEqual(t, len(key), 250, key)
+	assert.True(t, strings.HasPrefix(key, "app:sqlite:"+ns[:64]+":tttt"), key)
+	assert.Contains(t, key, ":SELECT_*_FROM_tttt")
+}
+
+func TestKeyNamespace(t *testing.T) {
+	config := gormcache.CacheConfig{TTL: time.Minute, KeyGenerator: gormcache.HashKeyGenerator{Namespace: tenantNamespace}}
+
+	keyA, _ := findWithKey(t, config, context.WithValue(cacheCtx(), tenantKey{}, "a"))
+	keyB, _ := findWithKey(t, config, context.WithValue(cacheCtx(), tenantKey{}, "b"))
+	assert.True(t, strings.HasPrefix(keyA, "tenant-a:"), keyA)
+	assert.True(t, strings.HasPrefix(keyB, "tenant-b:"), keyB)
+	assert.Equal(t, keyA[len("tenant-a:"):], keyB[len("tenant-b:"):])
+
+	// no tenant, no cache; the query still runs
+	key, cache := findWithKey(t, config, cacheCtx())
+	assert.Empty(t, key)
+	assert.Equal(t, gormcache.Stats{}, cache.Stats())
+}
+
+func TestCustomKeyGenerator(t *testing.T) {
+	key, _ := findWithKey(t, gormcache.CacheConfig{TTL: time.Minute, Prefix: "p:", KeyGenerator: staticKeys{}}, cacheCtx())
+	assert.Equal(t, "p:static", key)
+}
+
+func TestKeyNamespaceEntities(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("keys_cache", client, gormcache.CacheConfig{
+		TTL:            time.Minute,
+		KeyGenerator:   gormcache.HashKeyGenerator{Namespace: tenantNamespace},
+		Entities:       true,
+		NormalizeLists: true,
+	})
+	require.NoError(t, db.Use(cache))
+	tenantA := db.WithContext(context.WithValue(cacheCtx(), tenantKey{}, "a"))
+	tenantB := db.WithContext(context.WithValue(cacheCtx(), tenantKey{}, "b"))
+	name := func(tx *gorm.DB) string {
+		var user testUser
+		require.NoError(t, tx.First(&user, 1).Error)
+		return user.Name
+	}
+
+	// entities and lists are keyed in the scope of the tenant
+	assert.Equal(t, "user1", name(tenantA))
+	require.NoError(t, tenantA.Order("id").Find(&[]testUser{}).Error)
+	assert.Len(t, keysWith(t, client, "tenant-a:entity:"), 3)
+	assert.Len(t, keysWith(t, client, "tenant-a:ids:"), 1)
+	assert.Len(t, keysWith(t, client, ""), 4)
+
+	require.NoError(t, db.Exec("UPDATE test_users SET name = 'changed' WHERE id = 1").Error)
+	assert.Equal(t, "changed", name(tenantB))
+	assert.Equal(t, "user1", name(tenantA))
+
+	// no tenant, no cache
+	assert.Equal(t, "changed", name(db.WithContext(cacheCtx())))
+	assert.Len(t, keysWith(t, client, ""), 5)
+
+	// writes refresh the entity of their own scope
+	require.NoError(t, tenantB.Model(&testUser{ID: 1}).Update("name", "renamed").Error)
+	info, err := cache.Lookup(context.Background(), "tenant-b:entity:test_users:1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ID":1,"Name":"renamed"}`, string(info.Value))
+
+	_, err = cache.PurgePrefix(context.Background(), "tenant-a:")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tenant-b:entity:test_users:1"}, keysWith(t, client, ""))
+
+	// keys of generators without a scope cannot be followed
+	err = newTestDB(t, 0).Use(gormcache.NewGormCache("keys_cache", client, gormcache.CacheConfig{KeyGenerator: staticKeys{}, Entities: true}))
+	assert.ErrorIs(t, err, gormcache.ErrNoKeyScope)
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// listKey returns the key of the primary key list of a query, distinct
+// from its regular key and after the same prefix and scope
+func listKey(prefix, key string) string {
+	return prefix + "ids:" + strings.TrimPrefix(key, prefix)
+}
+
+// listQuery reports whether a query scans whole rows of its model into a
+// slice, so it can be cached as the list of their primary keys
+func listQuery(db *gorm.DB) bool {
+	stmt := db.Statement
+	s := stmt.Schema
+	if entityField(s) == nil || stmt.Table != s.Table || len(stmt.Joins) > 0 || len(stmt.Selects) > 0 || len(stmt.Omits) > 0 || stmt.Distinct {
+		return false
+	}
+	if _, ok := stmt.Clauses["FROM"]; !ok || inTransaction(db) {
+		return false // raw SQL, or rows the transaction may have changed
+	}
+	if stmt.Unscoped && hasSoftDelete(s) {
+		return false // deleted rows must not become entities
+	}
+	for name := range stmt.Clauses {
+		if !entityClauses[name] {
+			return false
+		}
+	}
+	if !stmt.ReflectValue.IsValid() || stmt.ReflectValue.Kind() != reflect.Slice {
+		return false
+	}
+	elem := stmt.ReflectValue.Type().Elem()
+	return elem == s.ModelType || elem == reflect.PointerTo(s.ModelType)
+}
+
+// loadList reads the primary key list of a query and assembles its rows
+// from the entities, fetching the missing ones with a single query. A
+// list naming a row that no longer exists is a miss.
+func (g *GormCache) loadList(db *gorm.DB, key string) (bool, error) {
+	value, err := g.get(db, key)
+	if err != nil || value == nil {
+		return false, err
+	}
+	entry, err := decodeEntry(value.([]byte))
+	if err != nil {
+		return false, err
+	}
+	if entry.expired(time.Now()) {
+		return false, nil
+	}
+
+	s := db.Statement.Schema
+	pks := reflect.New(reflect.SliceOf(entityField(s).FieldType))
+	if err = entry.Serializer.Unmarshal(entry.Payload, pks.Interface()); err != nil {
+		return false, err
+	}
+	rows, err := g.loadEntities(db, s, pks.Elem())
+	if err != nil || rows == nil {
+		return false, err
+	}
+
+	dest := db.Statement.ReflectValue
+	out := reflect.MakeSlice(dest.Type(), 0, len(rows))
+	for _, row := range rows {
+		if dest.Type().Elem().Kind() == reflect.Pointer {
+			out = reflect.Append(out, row)
+		} else {
+			out = reflect.Append(out, row.Elem())
+		}
+	}
+	dest.Set(out)
+	db.RowsAffected = int64(len(rows))
+	return true, nil
+}
+
+// loadEntities returns pointers to the rows of model s with the given
+// primary keys, in order, nil when one of them does not exist
+func (g *GormCache) loadEntities(db *gorm.DB, s *schema.Schema, pks reflect.Value) ([]reflect.Value, error) {
+	ctx := db.Statement.Context
+	prefix, err := g.keyPrefix(db)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, pks.Len())
+	for i := range keys {
+		keys[i] = g.entityKey(prefix, s, pks.Index(i).Interface())
+	}
+	values, err := getMulti(ctx, g.client, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rows := make([]reflect.Value, len(keys))
+	var missing []interface{}
+	for i, value := range values {
+		if data, ok := value.([]byte); ok {
+			entry, err := decodeEntry(data)
+			if err != nil {
+				return nil, err
+			}
+			if !entry.expired(now) {
+				rows[i] = reflect.New(s.ModelType)
+				if err = entry.Serializer.Unmarshal(entry.Payload, rows[i].Interface()); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		missing = append(missing, pks.Index(i).Interface())
+	}
+	if len(missing) == 0 {
+		return rows, nil
+	}
+
+	// one query for every missing row, stored back as entities
+	fetched := reflect.New(reflect.SliceOf(s.ModelType))
+	tx := db.Session(&gorm.Session{NewDB: true, Context: context.WithValue(ctx, UseCacheKey, false)})
+	if tx = tx.Find(fetched.Interface(), missing); tx.Error != nil {
+		return nil, tx.Error
+	}
+	g.storeEntities(ctx, tx, prefix, s, fetched.Elem(), g.ttl(db))
+
+	field := entityField(s)
+	byKey := make(map[string]reflect.Value, fetched.Elem().Len())
+	for i := 0; i < fetched.Elem().Len(); i++ {
+		row := fetched.Elem().Index(i)
+		pk, _ := field.ValueOf(ctx, row)
+		byKey[g.entityKey(prefix, s, pk)] = row.Addr()
+	}
+	for i, key := range keys {
+		if rows[i].IsValid() {
+			continue
+		}
+		if rows[i] = byKey[key]; !rows[i].IsValid() {
+			return nil, nil // deleted since the list was stored
+		}
+	}
+	return rows, nil
+}
+
+// setList stores the rows of a query as entities and the list of their
+// primary keys under key
+func (g *GormCache) setList(db *gorm.DB, key string) error {
+	if g.tooManyRows(key, db.RowsAffected) {
+		return nil
+	}
+	ctx, s, ttl := db.Statement.Context, db.Statement.Schema, g.ttl(db)
+	field := entityField(s)
+	rows := db.Statement.ReflectValue
+	pks := reflect.MakeSlice(reflect.SliceOf(field.FieldType), rows.Len(), rows.Len())
+	for i := 0; i < rows.Len(); i++ {
+		pk, _ := field.ValueOf(ctx, reflect.Indirect(rows.Index(i)))
+		pks.Index(i).Set(reflect.ValueOf(pk))
+	}
+	prefix, err := g.keyPrefix(db)
+	if err != nil {
+		return err
+	}
+	g.storeEntities(ctx, db, prefix, s, rows, ttl)
+
+	var meta *EntryMeta
+	if g.config.Metadata {
+		meta = g.newMeta(db, db.Statement.SQL.String(), db.Statement.Vars, queryTables(db), db.RowsAffected, pks.Interface(), ttl)
+	}
+	payload, err := g.encodeEntry(meta, pks.Interface(), ttl)
+	if err != nil {
+		return err
+	}
+	if g.tooLarge(key, payload) {
+		return nil
+	}
+	return g.store(ctx, key, payload, entryTags(db), ttl)
+}
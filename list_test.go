@@ -0,0 +1,133 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newListCache(t *testing.T, db *gorm.DB) (*gormcache.GormCache, *gormcache.MemoryClient) {
+	t.Helper()
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("list_cache", client, gormcache.CacheConfig{TTL: time.Minute, Entities: true, NormalizeLists: true})
+	require.NoError(t, db.Use(cache))
+	return cache, client
+}
+
+func keysWith(t *testing.T, client *gormcache.MemoryClient, prefix string) []string {
+	t.Helper()
+	keys, err := client.Keys(context.Background(), prefix)
+	require.NoError(t, err)
+	return keys
+}
+
+func TestListStoresKeysAndEntities(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, client := newListCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	low := func() (users []testUser) {
+		require.NoError(t, cdb.Where("id <= ?", 2).Order("id").Find(&users).Error)
+		return users
+	}
+	high := func() (users []*testUser) {
+		require.NoError(t, cdb.Where("id >= ?", 2).Order("id DESC").Find(&users).Error)
+		return users
+	}
+	assert.Equal(t, []testUser{{1, "user1"}, {2, "user2"}}, low())
+	assert.Equal(t, []*testUser{{3, "user3"}, {2, "user2"}}, high())
+	assert.Len(t, keysWith(t, client, "entity:"), 3, "the shared row is stored once")
+	listKeys := keysWith(t, client, "ids:")
+	require.Len(t, listKeys, 2)
+
+	assert.Equal(t, []testUser{{1, "user1"}, {2, "user2"}}, low())
+	assert.Equal(t, []*testUser{{3, "user3"}, {2, "user2"}}, high())
+	assert.Equal(t, uint64(2), cache.Stats().Hits)
+
+	info, err := cache.Lookup(context.Background(), listKeys[0])
+	require.NoError(t, err)
+	assert.Contains(t, []string{"[1,2]", "[3,2]"}, string(info.Value))
+}
+
+func TestListFollowsRowUpdates(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, _ := newListCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	var users []testUser
+	require.NoError(t, cdb.Order("id").Find(&users).Error)
+	require.NoError(t, db.Model(&testUser{ID: 2}).Update("name", "renamed").Error)
+
+	users = nil
+	require.NoError(t, cdb.Order("id").Find(&users).Error)
+	assert.Equal(t, []testUser{{1, "user1"}, {2, "renamed"}, {3, "user3"}}, users)
+	assert.Equal(t, uint64(1), cache.Stats().Hits, "the list itself was not invalidated")
+}
+
+func TestListFetchesMissingEntities(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, client := newListCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	require.NoError(t, cdb.Order("id").Find(&[]testUser{}).Error)
+	require.NoError(t, cache.Purge(context.Background(), "entity:test_users:1", "entity:test_users:3"))
+
+	var users []testUser
+	require.NoError(t, cdb.Order("id").Find(&users).Error)
+	assert.Equal(t, []testUser{{1, "user1"}, {2, "user2"}, {3, "user3"}}, users)
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+	assert.Len(t, keysWith(t, client, "entity:"), 3, "fetched rows are stored again")
+}
+
+func TestListWithDeletedRowMisses(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, _ := newListCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	require.NoError(t, cdb.Order("id").Find(&[]testUser{}).Error)
+	require.NoError(t, db.Delete(&testUser{ID: 3}).Error)
+
+	var users []testUser
+	require.NoError(t, cdb.Order("id").Find(&users).Error)
+	assert.Equal(t, []testUser{{1, "user1"}, {2, "user2"}}, users)
+	assert.Equal(t, gormcache.Stats{Misses: 2, Sets: 2}, cache.Stats())
+}
+
+func TestListUnscopedSoftDelete(t *testing.T) {
+	db := newTestDB(t, 0)
+	require.NoError(t, db.AutoMigrate(&softUser{}))
+	require.NoError(t, db.Create(&[]softUser{{ID: 1, Name: "kept"}, {ID: 2, Name: "deleted"}}).Error)
+	require.NoError(t, db.Delete(&softUser{ID: 2}).Error)
+	_, client := newListCache(t, db)
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+
+	// unscoped lists see deleted rows, they are not stored as entities
+	var users []softUser
+	require.NoError(t, cdb.Unscoped().Order("id").Find(&users).Error)
+	require.Len(t, users, 2)
+	assert.Empty(t, keysWith(t, client, "entity:"))
+	assert.Empty(t, keysWith(t, client, "ids:"))
+
+	assert.ErrorIs(t, cdb.First(&softUser{}, 2).Error, gorm.ErrRecordNotFound)
+}
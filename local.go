@@ -0,0 +1,210 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type cacheTagsKey struct{}
+
+// CacheTagsKey is the context key of extra tags, a []string, attached to
+// the entries of a query so they can be evicted together
+var CacheTagsKey cacheTagsKey
+
+// TableTag returns the tag carried by every entry reading table
+func TableTag(table string) string {
+	return "table:" + table
+}
+
+// Invalidation describes cache entries to evict
+type Invalidation struct {
+	Keys   []string `json:"keys,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Tables []string `json:"tables,omitempty"`
+	Flush  bool     `json:"flush,omitempty"` // evict everything
+}
+
+// Broadcaster publishes invalidations to the GormCache instances of other
+// processes, so they can evict their local layer
+type Broadcaster interface {
+	Publish(ctx context.Context, inv Invalidation) error
+}
+
+// entryTags returns the tags of a query entry: one per table it reads plus
+// the tags carried by the context
+func entryTags(db *gorm.DB) []string {
+	extra, _ := db.Statement.Context.Value(CacheTagsKey).([]string)
+	tables := queryTables(db)
+	tags := make([]string, 0, len(tables)+len(extra))
+	for _, table := range tables {
+		tags = append(tags, TableTag(table))
+	}
+	return append(tags, extra...)
+}
+
+// get reads key from the local layer first and then from the client,
+// copying client hits into the local layer
+func (g *GormCache) get(db *gorm.DB, key string) (interface{}, error) {
+	ctx := db.Statement.Context
+	if g.config.Local != nil {
+		value, err := g.config.Local.Get(ctx, key)
+		if err == nil && value != nil {
+			return value, nil
+		}
+	}
+
+	value, err := g.client.Get(ctx, key)
+	if err != nil || value == nil || g.config.Local == nil {
+		return value, err
+	}
+	if data, ok := value.([]byte); ok {
+		if ttl, ok := g.remainingTTL(db, key, data); ok {
+			g.setLocal(ctx, key, data, entryTags(db), ttl)
+		}
+	}
+	return value, nil
+}
+
+// remainingTTL returns how long an entry read from the client still
+// lives there, from the expiry the entry records or else from the client,
+// so the local copy does not outlive it. It falls back to the query ttl
+// when neither knows, and reports false for an entry about to expire.
+func (g *GormCache) remainingTTL(db *gorm.DB, key string, data []byte) (time.Duration, bool) {
+	if entry, err := decodeEntry(data); err == nil && !entry.ExpiresAt.IsZero() {
+		ttl := time.Until(entry.ExpiresAt)
+		return ttl, ttl > 0
+	}
+	if reader, ok := g.client.(TTLReader); ok {
+		ttl, found, err := reader.TTL(db.Statement.Context, key)
+		if err == nil && found && ttl > 0 {
+			return ttl, true
+		}
+		if err == nil && !found {
+			return 0, false // gone since it was read
+		}
+	}
+	return g.ttl(db), true
+}
+
+// setLocal stores data in the local layer with tags, for ttl capped by
+// LocalTTL
+func (g *GormCache) setLocal(ctx context.Context, key string, data []byte, tags []string, ttl time.Duration) {
+	if g.config.Local == nil {
+		return
+	}
+	if g.config.LocalTTL > 0 && (ttl <= 0 || g.config.LocalTTL < ttl) {
+		ttl = g.config.LocalTTL
+	}
+	if err := g.config.Local.Set(ctx, key, storable(data), ttl); err != nil {
+		log.Printf("*** set local cache failed: %v", err)
+		return
+	}
+	if tagger, ok := g.config.Local.(Tagger); ok {
+		if err := tagger.Tag(ctx, key, tags, ttl); err != nil {
+			log.Printf("*** tag local cache failed: %v", err)
+		}
+	}
+}
+
+// EvictLocal evicts entries from the local layer only. It is what an
+// invalidation broadcast by another process triggers.
+func (g *GormCache) EvictLocal(ctx context.Context, inv Invalidation) error {
+	local := g.config.Local
+	if local == nil {
+		return nil
+	}
+	if inv.Flush {
+		flusher, ok := local.(Flusher)
+		if !ok {
+			return fmt.Errorf("%w: Flusher", ErrNotSupported)
+		}
+		return flusher.Flush(ctx)
+	}
+
+	var errs []error
+	if len(inv.Keys) > 0 {
+		if deleter, ok := local.(Deleter); ok {
+			errs = append(errs, deleter.Delete(ctx, inv.Keys...))
+		} else {
+			errs = append(errs, fmt.Errorf("%w: Deleter", ErrNotSupported))
+		}
+	}
+	if tags := inv.tags(); len(tags) > 0 {
+		if tagger, ok := local.(Tagger); ok {
+			errs = append(errs, tagger.DeleteTags(ctx, tags...))
+		} else {
+			errs = append(errs, fmt.Errorf("%w: Tagger", ErrNotSupported))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Evict evicts entries from the local layer and broadcasts the
+// invalidation to the other processes
+func (g *GormCache) Evict(ctx context.Context, inv Invalidation) error {
+	err := g.EvictLocal(ctx, inv)
+	if g.config.Broadcaster != nil {
+		err = errors.Join(err, g.config.Broadcaster.Publish(ctx, inv))
+	}
+	return err
+}
+
+// tags returns the tags and the table tags of the invalidation
+func (inv Invalidation) tags() []string {
+	tags := append([]string(nil), inv.Tags...)
+	for _, table := range inv.Tables {
+		tags = append(tags, TableTag(table))
+	}
+	return tags
+}
+
+// localCallback evicts the table written by a create, update or delete
+// statement from every local layer
+func (g *GormCache) localCallback(db *gorm.DB) {
+	if db.Error != nil || db.DryRun || db.Statement.Table == "" {
+		return
+	}
+	ctx, inv := context.WithoutCancel(db.Statement.Context), Invalidation{Tables: []string{db.Statement.Table}}
+	evict := func() {
+		if err := g.Evict(ctx, inv); err != nil {
+			log.Printf("*** evict table %v failed: %v", db.Statement.Table, err)
+		}
+	}
+	if tx := g.bufferedTxOf(db); tx != nil {
+		tx.buffer(evict)
+		return
+	}
+	evict()
+}
+
+// registerLocal registers localCallback after every write
+func (g *GormCache) registerLocal(db *gorm.DB) error {
+	if err := db.Callback().Create().After("gorm:create").Register("gormcache:local", g.localCallback); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:update").Register("gormcache:local", g.localCallback); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("gormcache:local", g.localCallback)
+}
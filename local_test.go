@@ -0,0 +1,116 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// recordingBroadcaster keeps the published invalidations.
+type recordingBroadcaster struct {
+	published []gormcache.Invalidation
+}
+
+func (r *recordingBroadcaster) Publish(_ context.Context, inv gormcache.Invalidation) error {
+	r.published = append(r.published, inv)
+	return nil
+}
+
+func TestLocalLayer(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := newMockCacheClient()
+	local := gormcache.NewMemoryClient()
+	broadcaster := &recordingBroadcaster{}
+	cache := gormcache.NewGormCache("local_cache", client, gormcache.CacheConfig{
+		TTL:         time.Minute,
+		Local:       local,
+		Broadcaster: broadcaster,
+	})
+	require.NoError(t, db.Use(cache))
+
+	find := func(ctx context.Context) {
+		var users []testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: ctx}).Find(&users).Error)
+		assert.Len(t, users, 2)
+	}
+
+	tagged := context.WithValue(cacheCtx(), gormcache.CacheTagsKey, []string{"report"})
+	find(tagged)
+	assert.Equal(t, 1, local.Len())
+	gets := client.gets
+	find(tagged)
+	assert.Equal(t, gets, client.gets, "served by the local layer")
+
+	// evicting by tag only touches the local layer
+	require.NoError(t, cache.EvictLocal(context.Background(), gormcache.Invalidation{Tags: []string{"report"}}))
+	assert.Equal(t, 0, local.Len())
+	find(tagged)
+	assert.Equal(t, gets+1, client.gets, "refilled from the client")
+	assert.Equal(t, 1, local.Len())
+
+	// writes evict the table locally and are broadcast
+	require.NoError(t, db.Create(&testUser{ID: 3, Name: "user3"}).Error)
+	assert.Equal(t, 0, local.Len())
+	require.Len(t, broadcaster.published, 1)
+	assert.Equal(t, []string{"test_users"}, broadcaster.published[0].Tables)
+
+	find(cacheCtx())
+	require.NoError(t, cache.EvictLocal(context.Background(), gormcache.Invalidation{Flush: true}))
+	assert.Equal(t, 0, local.Len())
+}
+
+func TestLocalLayerKeepsRemainingTTL(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		client gormcache.CacheClient
+		config gormcache.CacheConfig
+	}{
+		{"envelope expiry", newMockCacheClient(), gormcache.CacheConfig{Envelope: true}},
+		{"client ttl", gormcache.NewMemoryClient(), gormcache.CacheConfig{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t, 2)
+			local := gormcache.NewMemoryClient()
+			tc.config.TTL, tc.config.Local = time.Minute, local
+			cache := gormcache.NewGormCache("local_cache", tc.client, tc.config)
+			require.NoError(t, db.Use(cache))
+
+			require.NoError(t, db.WithContext(cacheCtx()).Find(&[]testUser{}).Error)
+			require.NoError(t, local.Flush(context.Background()))
+
+			// refilled from the client for what is left of the minute, not
+			// for the ttl of the query reading it
+			ctx := context.WithValue(cacheCtx(), gormcache.CacheTTLKey, time.Hour)
+			require.NoError(t, db.WithContext(ctx).Find(&[]testUser{}).Error)
+			keys, err := local.Keys(context.Background(), "")
+			require.NoError(t, err)
+			require.Len(t, keys, 1)
+			ttl, found, err := local.TTL(context.Background(), keys[0])
+			require.NoError(t, err)
+			require.True(t, found)
+			assert.LessOrEqual(t, ttl, time.Minute)
+			assert.Greater(t, ttl, 50*time.Second)
+		})
+	}
+}
@@ -19,6 +19,7 @@ package gormcachememcached
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	memcache "github.com/bradfitz/gomemcache/memcache"
@@ -47,11 +48,64 @@ func (r *MemcacheClient) Get(ctx context.Context, key string) (interface{}, erro
 	return value, nil
 }
 
-// Set sets value to memcache by key with ttl using json encoding/decoding
-func (r *MemcacheClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
-	data, err := json.Marshal(value) // encode value to json bytes using json encoding/decoding
+// GetMulti gets the values of keys from memcache in one round trip per
+// server, nil for missing keys
+func (r *MemcacheClient) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	items, err := r.client.GetMulti(keys)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if item, ok := items[key]; ok {
+			values[i] = item.Value
+		}
+	}
+	return values, nil
+}
+
+// Set sets value to memcache by key with ttl, []byte values as they are and
+// anything else using json encoding
+func (r *MemcacheClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, ok := value.([]byte) // encoded entries are stored verbatim
+	if !ok {
+		var err error
+		if data, err = json.Marshal(value); err != nil { // encode value to json bytes using json encoding/decoding
+			return err
+		}
 	}
 	return r.client.Set(&memcache.Item{Key: key, Value: data, Expiration: int32(ttl.Seconds())})
 }
+
+// Incr atomically increments the counter stored at key, creating it when
+// it does not exist yet
+func (r *MemcacheClient) Incr(ctx context.Context, key string) (int64, error) {
+	n, err := r.client.Increment(key, 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = r.client.Add(&memcache.Item{Key: key, Value: []byte("1")})
+		if err == nil {
+			return 1, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 0, err
+		}
+		// another client created it in between
+		n, err = r.client.Increment(key, 1)
+	}
+	return int64(n), err
+}
+
+// Delete deletes keys from memcache, ignoring the keys already missing
+func (r *MemcacheClient) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := r.client.Delete(key); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush invalidates every item of the memcache servers
+func (r *MemcacheClient) Flush(ctx context.Context) error {
+	return r.client.FlushAll()
+}
@@ -0,0 +1,268 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often expired entries are dropped from a
+// MemoryClient
+const memorySweepInterval = time.Minute
+
+// DefaultMemoryMaxEntries bounds the MemoryClient returned by
+// NewMemoryClient
+const DefaultMemoryMaxEntries = 10000
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // zero means no expiration
+	tags    []string
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// size is what the entry counts against the byte bound
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// MemoryClient is an in-process CacheClient, meant as the local layer in
+// front of a shared backend. It implements every optional capability but
+// Incrementer. Past its bounds it evicts the least recently used entries.
+type MemoryClient struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element // of *memoryEntry
+	lru        *list.List               // most recently used first
+	tags       map[string]map[string]struct{}
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+	lastSweep  time.Time
+}
+
+// NewMemoryClient returns a new MemoryClient instance holding at most
+// DefaultMemoryMaxEntries entries
+func NewMemoryClient() *MemoryClient {
+	return NewBoundedMemoryClient(DefaultMemoryMaxEntries, 0)
+}
+
+// NewBoundedMemoryClient returns a new MemoryClient instance holding at
+// most maxEntries entries and maxBytes bytes of keys and values, 0 meaning
+// no bound
+func NewBoundedMemoryClient(maxEntries int, maxBytes int64) *MemoryClient {
+	return &MemoryClient{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		tags:       make(map[string]map[string]struct{}),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lastSweep:  time.Now(),
+	}
+}
+
+// Get gets value from memory by key
+func (m *MemoryClient) Get(ctx context.Context, key string) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := elem.Value.(*memoryEntry)
+	if e.expired(time.Now()) {
+		m.delete(key)
+		return nil, nil
+	}
+	m.lru.MoveToFront(elem)
+	return e.value, nil
+}
+
+// GetMulti gets the values of keys from memory, nil for missing keys
+func (m *MemoryClient) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i], _ = m.Get(ctx, key)
+	}
+	return values, nil
+}
+
+// Set sets value to memory by key with ttl, []byte values as they are and
+// anything else using json encoding
+func (m *MemoryClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, ok := value.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.delete(key)
+	e := &memoryEntry{key: key, value: data}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	m.entries[key] = m.lru.PushFront(e)
+	m.bytes += e.size()
+
+	if now.Sub(m.lastSweep) >= memorySweepInterval {
+		for k, elem := range m.entries {
+			if elem.Value.(*memoryEntry).expired(now) {
+				m.delete(k)
+			}
+		}
+		m.lastSweep = now
+	}
+	for m.lru.Len() > 0 && (m.maxEntries > 0 && m.lru.Len() > m.maxEntries || m.maxBytes > 0 && m.bytes > m.maxBytes) {
+		m.delete(m.lru.Back().Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+// Delete deletes keys
+func (m *MemoryClient) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		m.delete(key)
+	}
+	return nil
+}
+
+// Tag associates an existing key with tags. The ttl is unused, tags go
+// away with their key.
+func (m *MemoryClient) Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*memoryEntry)
+	for _, tag := range tags {
+		keys, ok := m.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			m.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	e.tags = append(e.tags, tags...)
+	return nil
+}
+
+// DeleteTags deletes every key carrying one of tags
+func (m *MemoryClient) DeleteTags(ctx context.Context, tags ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tag := range tags {
+		for key := range m.tags[tag] {
+			m.delete(key)
+		}
+	}
+	return nil
+}
+
+// Flush deletes every key
+func (m *MemoryClient) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = make(map[string]*list.Element)
+	m.lru.Init()
+	m.tags = make(map[string]map[string]struct{})
+	m.bytes = 0
+	return nil
+}
+
+// TTL returns the remaining time to live of key
+func (m *MemoryClient) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	now := time.Now()
+	if !ok || elem.Value.(*memoryEntry).expired(now) {
+		return 0, false, nil
+	}
+	e := elem.Value.(*memoryEntry)
+	if e.expires.IsZero() {
+		return 0, true, nil
+	}
+	return e.expires.Sub(now), true, nil
+}
+
+// Keys lists the keys starting with prefix
+func (m *MemoryClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, elem := range m.entries {
+		if strings.HasPrefix(key, prefix) && !elem.Value.(*memoryEntry).expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Len returns the number of entries, including expired ones not swept yet
+func (m *MemoryClient) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Bytes returns the size of the keys and values held, including expired
+// ones not swept yet
+func (m *MemoryClient) Bytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// delete removes a key and its tag references, the lock must be held
+func (m *MemoryClient) delete(key string) {
+	elem, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*memoryEntry)
+	m.lru.Remove(elem)
+	m.bytes -= e.size()
+	for _, tag := range e.tags {
+		if keys, ok := m.tags[tag]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(m.tags, tag)
+			}
+		}
+	}
+	delete(m.entries, key)
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryClient(t *testing.T) {
+	ctx := context.Background()
+	m := gormcache.NewMemoryClient()
+
+	require.NoError(t, m.Set(ctx, "a", []int{1, 2}, 0))
+	require.NoError(t, m.Set(ctx, "b", "x", 0))
+	require.NoError(t, m.Set(ctx, "c", "y", 10*time.Millisecond))
+	require.NoError(t, m.Tag(ctx, "a", []string{"t1"}, 0))
+	require.NoError(t, m.Tag(ctx, "b", []string{"t1", "t2"}, 0))
+
+	value, err := m.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("[1,2]"), value)
+
+	time.Sleep(20 * time.Millisecond)
+	value, _ = m.Get(ctx, "c")
+	assert.Nil(t, value, "expired")
+
+	require.NoError(t, m.DeleteTags(ctx, "t2"))
+	value, _ = m.Get(ctx, "b")
+	assert.Nil(t, value)
+	value, _ = m.Get(ctx, "a")
+	assert.NotNil(t, value)
+
+	require.NoError(t, m.Delete(ctx, "a"))
+	assert.Equal(t, 0, m.Len())
+
+	require.NoError(t, m.Set(ctx, "d", 1, 0))
+	require.NoError(t, m.Flush(ctx))
+	assert.Equal(t, 0, m.Len())
+}
+
+func TestMemoryClientBounds(t *testing.T) {
+	ctx := context.Background()
+	get := func(m *gormcache.MemoryClient, key string) interface{} {
+		value, _ := m.Get(ctx, key)
+		return value
+	}
+
+	// the least recently used entry goes first, whatever its ttl
+	m := gormcache.NewBoundedMemoryClient(2, 0)
+	require.NoError(t, m.Set(ctx, "a", []byte("1"), 0))
+	require.NoError(t, m.Set(ctx, "b", []byte("2"), 0))
+	require.NoError(t, m.Tag(ctx, "b", []string{"t"}, 0))
+	assert.NotNil(t, get(m, "a"))
+	require.NoError(t, m.Set(ctx, "c", []byte("3"), 0))
+	assert.Equal(t, 2, m.Len())
+	assert.Nil(t, get(m, "b"))
+	assert.NotNil(t, get(m, "a"))
+	assert.NotNil(t, get(m, "c"))
+
+	// keys and values count against the byte bound
+	m = gormcache.NewBoundedMemoryClient(0, 10)
+	require.NoError(t, m.Set(ctx, "a", []byte("1234"), 0))
+	require.NoError(t, m.Set(ctx, "b", []byte("1234"), 0))
+	assert.Equal(t, int64(10), m.Bytes())
+	require.NoError(t, m.Set(ctx, "c", []byte("1"), 0))
+	assert.Nil(t, get(m, "a"))
+	assert.Equal(t, int64(7), m.Bytes())
+
+	// an entry larger than the bound is not kept
+	require.NoError(t, m.Set(ctx, "d", []byte("0123456789"), 0))
+	assert.Nil(t, get(m, "d"))
+	assert.Equal(t, 0, m.Len())
+	assert.Equal(t, int64(0), m.Bytes())
+}
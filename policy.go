@@ -0,0 +1,149 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Cacheable is implemented by models declaring their own cache policy,
+// applied to their queries without context values
+type Cacheable interface {
+	CacheEnabled() bool      // true caches queries without UseCacheKey, false never caches them
+	CacheTTL() time.Duration // ttl of the entries, the configured TTL when 0
+}
+
+// modelPolicy is the cache policy of a model given by a gormcache tag
+type modelPolicy struct {
+	enabled bool
+	ttl     time.Duration
+}
+
+// CacheEnabled implements Cacheable
+func (p modelPolicy) CacheEnabled() bool { return p.enabled }
+
+// CacheTTL implements Cacheable
+func (p modelPolicy) CacheTTL() time.Duration { return p.ttl }
+
+// policies memoizes the policy of each model type, nil for models
+// without one
+var policies sync.Map // reflect.Type -> Cacheable
+
+// policyOf returns the cache policy of model s: the model itself when it
+// implements Cacheable, or its gormcache tag, nil when it has neither
+func policyOf(s *schema.Schema) Cacheable {
+	if s == nil {
+		return nil
+	}
+	if p, ok := policies.Load(s.ModelType); ok {
+		policy, _ := p.(Cacheable)
+		return policy
+	}
+
+	var policy Cacheable
+	if c, ok := reflect.New(s.ModelType).Interface().(Cacheable); ok {
+		policy = c // asked on every query, the answer may change
+	} else if p, err := tagPolicy(s.ModelType); err != nil {
+		log.Printf("*** gormcache tag of %v ignored: %v", s.ModelType, err)
+	} else if p != nil {
+		policy = *p
+	}
+	policies.Store(s.ModelType, policy)
+	return policy
+}
+
+// tagPolicy parses the gormcache tag of a field of struct t, usually a
+// blank one: "-" never caches the model, "ttl=5m" caches it for 5
+// minutes, and "enabled=false" turns it off with the options kept
+func tagPolicy(t reflect.Type) (*modelPolicy, error) {
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("gormcache")
+		if !ok {
+			continue
+		}
+		p := &modelPolicy{enabled: tag != "-"}
+		if tag == "-" {
+			return p, nil
+		}
+		for _, option := range strings.Split(tag, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			var err error
+			switch strings.ToLower(name) {
+			case "":
+			case "ttl":
+				p.ttl, err = time.ParseDuration(value)
+			case "enabled":
+				p.enabled, err = strconv.ParseBool(value)
+			default:
+				err = fmt.Errorf("unknown option %q", name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+	return nil, nil
+}
+
+// neverCached reports whether the policy of model s turns its cache off
+func neverCached(s *schema.Schema) bool {
+	p := policyOf(s)
+	return p != nil && !p.CacheEnabled()
+}
+
+// joinsNeverCached reports whether the statement joins a relation, or a
+// relation on the way to a nested one, whose model is never cached
+func joinsNeverCached(stmt *gorm.Statement) bool {
+	if stmt.Schema == nil {
+		return false
+	}
+	for _, join := range stmt.Joins {
+		s := stmt.Schema
+		for _, name := range strings.Split(join.Name, ".") {
+			rel, ok := s.Relationships.Relations[name]
+			if !ok {
+				break // a join written as SQL
+			}
+			if neverCached(rel.FieldSchema) {
+				return true
+			}
+			s = rel.FieldSchema
+		}
+	}
+	return false
+}
+
+// modelTTL returns the ttl of the entries of model s before jitter: the
+// model's own, or the configured one
+func (g *GormCache) modelTTL(s *schema.Schema) time.Duration {
+	if p := policyOf(s); p != nil {
+		if ttl := p.CacheTTL(); ttl > 0 {
+			return ttl
+		}
+	}
+	return g.config.TTL
+}
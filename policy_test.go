@@ -0,0 +1,222 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// refCountry is a reference table, always cached for an hour
+type refCountry struct {
+	ID   int
+	Name string
+}
+
+func (refCountry) CacheEnabled() bool      { return true }
+func (refCountry) CacheTTL() time.Duration { return time.Hour }
+
+// switchedRate is cached while rateCaching is on
+type switchedRate struct {
+	ID   int
+	Rate float64
+}
+
+var rateCaching = true
+
+func (*switchedRate) CacheEnabled() bool      { return rateCaching }
+func (*switchedRate) CacheTTL() time.Duration { return 0 }
+
+// secretToken is never cached
+type secretToken struct {
+	_     struct{} `gormcache:"-"`
+	ID    int
+	Token string
+}
+
+// taggedPlan is cached for 5 minutes
+type taggedPlan struct {
+	_    struct{} `gormcache:"ttl=5m"`
+	ID   int
+	Name string
+}
+
+// mistaggedPlan has a tag that cannot be parsed
+type mistaggedPlan struct {
+	_    struct{} `gormcache:"ttl=soon"`
+	ID   int
+	Name string
+}
+
+func newPolicyDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := newTestDB(t, 2)
+	require.NoError(t, db.AutoMigrate(&refCountry{}, &switchedRate{}, &secretToken{}, &taggedPlan{}, &mistaggedPlan{}))
+	require.NoError(t, db.Create(&refCountry{ID: 1, Name: "Mexico"}).Error)
+	require.NoError(t, db.Create(&switchedRate{ID: 1, Rate: 0.16}).Error)
+	require.NoError(t, db.Create(&secretToken{ID: 1, Token: "s3cr3t"}).Error)
+	require.NoError(t, db.Create(&taggedPlan{ID: 1, Name: "basic"}).Error)
+	require.NoError(t, db.Create(&mistaggedPlan{ID: 1, Name: "basic"}).Error)
+	return db
+}
+
+func TestModelPolicy(t *testing.T) {
+	db := newPolicyDB(t)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("policy_cache", client, gormcache.CacheConfig{TTL: time.Minute, Prefix: "policy:"})
+	require.NoError(t, db.Use(cache))
+
+	// cached without context values, with the model's ttl
+	for i := 0; i < 2; i++ {
+		var countries []refCountry
+		require.NoError(t, db.Find(&countries).Error)
+		assert.Equal(t, []refCountry{{ID: 1, Name: "Mexico"}}, countries)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+	assert.NotEmpty(t, keyWithTTL(client, time.Hour))
+
+	// the context still decides the ttl, and may opt out
+	ctx := context.WithValue(context.Background(), gormcache.CacheTTLKey, 10*time.Second)
+	require.NoError(t, db.WithContext(ctx).Where("id = ?", 1).Find(&[]refCountry{}).Error)
+	assert.Equal(t, uint64(2), cache.Stats().Sets)
+	assert.NotEmpty(t, keyWithTTL(client, 10*time.Second))
+	ctx = context.WithValue(context.Background(), gormcache.UseCacheKey, false)
+	require.NoError(t, db.WithContext(ctx).Find(&[]refCountry{}).Error)
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+
+	// never cached, even when the context asks for it
+	for i := 0; i < 2; i++ {
+		var tokens []secretToken
+		require.NoError(t, db.WithContext(cacheCtx()).Find(&tokens).Error)
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "s3cr3t", tokens[0].Token)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 2, Sets: 2}, cache.Stats())
+
+	// the tag gives the ttl
+	before := len(client.ttls)
+	require.NoError(t, db.Find(&[]taggedPlan{}).Error)
+	require.Len(t, client.ttls, before+1)
+	assert.NotEmpty(t, keyWithTTL(client, 5*time.Minute))
+
+	// models without a policy follow the context
+	require.NoError(t, db.Find(&[]testUser{}).Error)
+	assert.Len(t, client.ttls, before+1)
+}
+
+func TestModelPolicyAskedPerQuery(t *testing.T) {
+	db := newPolicyDB(t)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("policy_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+	t.Cleanup(func() { rateCaching = true })
+
+	find := func() {
+		var rates []switchedRate
+		require.NoError(t, db.Find(&rates).Error)
+		assert.Len(t, rates, 1)
+	}
+	find()
+	find()
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+	assert.NotEmpty(t, keyWithTTL(client, time.Minute)) // configured ttl
+
+	rateCaching = false
+	find()
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+}
+
+func TestModelPolicyBadTag(t *testing.T) {
+	db := newPolicyDB(t)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("policy_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	// ignored, the model follows the context
+	require.NoError(t, db.Find(&[]mistaggedPlan{}).Error)
+	assert.Equal(t, gormcache.Stats{}, cache.Stats())
+	require.NoError(t, db.WithContext(cacheCtx()).Find(&[]mistaggedPlan{}).Error)
+	assert.Equal(t, gormcache.Stats{Misses: 1, Sets: 1}, cache.Stats())
+}
+
+func TestModelPolicyEntities(t *testing.T) {
+	db := newPolicyDB(t)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("policy_cache", client, gormcache.CacheConfig{TTL: time.Minute, Entities: true})
+	require.NoError(t, db.Use(cache))
+
+	// writes refresh the entities of cached models only
+	require.NoError(t, db.Model(&refCountry{ID: 1}).Update("name", "México").Error)
+	require.NoError(t, db.Model(&secretToken{ID: 1}).Update("token", "rotated").Error)
+	assert.Len(t, keysWith(t, client, "entity:ref_countries:"), 1)
+	assert.Empty(t, keysWith(t, client, "entity:secret_tokens:"))
+}
+
+// tokenOwner belongs to a model that is never cached
+type tokenOwner struct {
+	ID      int
+	Name    string
+	TokenID int
+	Token   secretToken
+}
+
+func TestModelPolicyAssociations(t *testing.T) {
+	db := newPolicyDB(t)
+	require.NoError(t, db.AutoMigrate(&tokenOwner{}))
+	require.NoError(t, db.Create(&tokenOwner{ID: 1, Name: "ann", TokenID: 1}).Error)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("policy_cache", client, gormcache.CacheConfig{TTL: time.Minute, Preloads: true})
+	require.NoError(t, db.Use(cache))
+
+	queries := map[string]func(tx *gorm.DB) *gorm.DB{
+		"preload": func(tx *gorm.DB) *gorm.DB { return tx.Preload("Token") },
+		"join":    func(tx *gorm.DB) *gorm.DB { return tx.Joins("Token") },
+	}
+	for name, query := range queries {
+		require.NoError(t, db.Model(&secretToken{ID: 1}).Update("token", "s3cr3t").Error)
+		for _, want := range []string{"s3cr3t", "rotated"} {
+			var owners []tokenOwner
+			require.NoError(t, query(db.WithContext(cacheCtx())).Find(&owners).Error)
+			require.Len(t, owners, 1)
+			assert.Equal(t, want, owners[0].Token.Token, name)
+			require.NoError(t, db.Model(&secretToken{ID: 1}).Update("token", "rotated").Error)
+		}
+	}
+
+	// the owners alone are cached, never with their tokens
+	for _, key := range keysWith(t, client, "") {
+		info, err := cache.Lookup(context.Background(), key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(info.Value), "s3cr3t", key)
+	}
+}
+
+// keyWithTTL returns a key client stored with ttl
+func keyWithTTL(client *mockCacheClient, ttl time.Duration) string {
+	for key, t := range client.ttls {
+		if t == ttl {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// graphKey is the gorm instance setting of a query cached together with
+// its preloaded associations
+const graphKey = "gormcache:graph"
+
+// graphQuery is the state of a query cached with its preloads
+type graphQuery struct {
+	preloads string   // description of the preloads, part of the key
+	tables   []string // tables of the preloaded associations
+	key      string   // set on a miss, the graph is stored once preloaded
+	hit      bool     // served from the cache, associations included
+}
+
+// graphOf returns the graph state of the query of db, nil when it is not
+// cached with its preloads
+func graphOf(db *gorm.DB) *graphQuery {
+	graph, _ := db.InstanceGet(graphKey)
+	g, _ := graph.(*graphQuery)
+	return g
+}
+
+// newGraph returns the graph state of a query with preloads, nil when it
+// has none, they cannot be part of a key, e.g. conditions given as
+// functions, or they reach a model that is never cached
+func newGraph(db *gorm.DB) *graphQuery {
+	s := db.Statement.Schema
+	if s == nil || len(db.Statement.Preloads) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(db.Statement.Preloads))
+	for name := range db.Statement.Preloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	graph := &graphQuery{}
+	var desc strings.Builder
+	tables := map[string]struct{}{}
+	for _, name := range names {
+		conds := db.Statement.Preloads[name]
+		for _, cond := range conds {
+			if _, ok := cond.(string); !ok && !isScalar(reflect.ValueOf(cond)) {
+				return nil
+			}
+		}
+		if !preloadTables(s, name, tables) {
+			return nil
+		}
+		if writeVar(&desc, name) != nil || writeVar(&desc, conds) != nil {
+			return nil
+		}
+	}
+	graph.preloads = desc.String()
+	for table := range tables {
+		graph.tables = append(graph.tables, table)
+	}
+	return graph
+}
+
+// preloadTables adds the tables read by the preload name of model s, a
+// path of relations such as "Orders.Items", to tables. It reports false
+// for a name that is not a path of relations, or that reaches a model
+// that is never cached.
+func preloadTables(s *schema.Schema, name string, tables map[string]struct{}) bool {
+	for _, part := range strings.Split(name, ".") {
+		if part == clause.Associations {
+			for _, rel := range s.Relationships.Relations {
+				if neverCached(rel.FieldSchema) {
+					return false
+				}
+				addRelation(rel, tables)
+			}
+			return true
+		}
+		rel, ok := s.Relationships.Relations[part]
+		if !ok || neverCached(rel.FieldSchema) {
+			return false
+		}
+		addRelation(rel, tables)
+		s = rel.FieldSchema
+	}
+	return true
+}
+
+// addRelation adds the table of a relation, and its join table, to tables
+func addRelation(rel *schema.Relationship, tables map[string]struct{}) {
+	tables[rel.FieldSchema.Table] = struct{}{}
+	if rel.JoinTable != nil {
+		tables[rel.JoinTable.Table] = struct{}{}
+	}
+}
+
+// preloadCallback replaces gorm:preload. A graph served from the cache is
+// not preloaded again, and a graph missed is stored once preloaded.
+func (g *GormCache) preloadCallback(db *gorm.DB) {
+	graph := graphOf(db)
+	if graph != nil && graph.hit {
+		return
+	}
+	if graph == nil {
+		callbacks.Preload(db)
+		return
+	}
+
+	// the graph entry holds the associations, their queries are not cached
+	ctx := db.Statement.Context
+	db.Statement.Context = context.WithValue(ctx, UseCacheKey, false)
+	callbacks.Preload(db)
+	db.Statement.Context = ctx
+	if graph.key == "" || !cacheable(db) {
+		return
+	}
+
+	var err error
+	if tx := g.bufferedTxOf(db); tx != nil {
+		err = g.bufferSet(tx, db, graph.key)
+	} else {
+		err = g.setCache(db, graph.key)
+	}
+	if err != nil {
+		g.counters.errors.Add(1)
+		log.Printf("*** set cache failed: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type graphCustomer struct {
+	ID     int
+	Name   string
+	Orders []graphOrder `gorm:"foreignKey:CustomerID"`
+	Labels []graphLabel `gorm:"many2many:graph_customer_labels"`
+}
+
+type graphOrder struct {
+	ID         int
+	CustomerID int
+	State      string
+	Items      []graphItem `gorm:"foreignKey:OrderID"`
+}
+
+type graphItem struct {
+	ID      int
+	OrderID int
+	Name    string
+}
+
+type graphLabel struct {
+	ID   int
+	Name string
+}
+
+func newGraphDB(t *testing.T, client gormcache.CacheClient, config gormcache.CacheConfig) (*gorm.DB, *gormcache.GormCache) {
+	t.Helper()
+	db := newTestDB(t, 0)
+	require.NoError(t, db.AutoMigrate(&graphCustomer{}, &graphOrder{}, &graphItem{}, &graphLabel{}))
+	require.NoError(t, db.Create(&[]graphCustomer{
+		{ID: 1, Name: "ann", Labels: []graphLabel{{ID: 1, Name: "vip"}}, Orders: []graphOrder{
+			{ID: 1, State: "paid", Items: []graphItem{{ID: 1, Name: "apple"}, {ID: 2, Name: "pear"}}},
+			{ID: 2, State: "open", Items: []graphItem{{ID: 3, Name: "fig"}}},
+		}},
+		{ID: 2, Name: "bob", Orders: []graphOrder{{ID: 3, State: "paid"}}},
+	}).Error)
+
+	cache := gormcache.NewGormCache("graph_cache", client, config)
+	require.NoError(t, db.Use(cache))
+	return db, cache
+}
+
+var graphCases = []e2eCase{
+	{"nested", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var customers []graphCustomer
+		return &customers, db.Preload("Orders.Items").Order("id").Find(&customers)
+	}},
+	{"conditions", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var customers []graphCustomer
+		return &customers, db.Preload("Orders", "state = ?", "paid").Order("id").Find(&customers)
+	}},
+	{"associations", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var customer graphCustomer
+		return &customer, db.Preload(clause.Associations).First(&customer, 1)
+	}},
+	{"missing", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var customer graphCustomer
+		return &customer, db.Preload("Orders").First(&customer, 100)
+	}},
+	{"no preload", func(db *gorm.DB) (interface{}, *gorm.DB) {
+		var customers []graphCustomer
+		return &customers, db.Order("id").Find(&customers)
+	}},
+}
+
+// TestPreloadGraph checks that a graph hit equals the uncached query and
+// does not preload again: rows changed behind GORM's back stay unseen
+func TestPreloadGraph(t *testing.T) {
+	db, cache := newGraphDB(t, gormcache.NewMemoryClient(), gormcache.CacheConfig{TTL: time.Minute, Preloads: true, Entities: true, NormalizeLists: true})
+
+	wants := make([]interface{}, len(graphCases))
+	for i, c := range graphCases {
+		want, tx := c.run(db)
+		wants[i] = want
+		got, gotTx := c.run(db.WithContext(cacheCtx()))
+		assert.Equal(t, want, got, c.name)
+		assert.Equal(t, tx.RowsAffected, gotTx.RowsAffected, c.name)
+		assert.Equal(t, tx.Error, gotTx.Error, c.name)
+	}
+
+	require.NoError(t, db.Exec("UPDATE graph_items SET name = ?", "changed").Error)
+	require.NoError(t, db.Exec("UPDATE graph_orders SET state = ?", "paid").Error)
+	require.NoError(t, db.Exec("DELETE FROM graph_customer_labels").Error)
+	for i, c := range graphCases {
+		got, _ := c.run(db.WithContext(cacheCtx()))
+		assert.Equal(t, wants[i], got, c.name)
+	}
+	assert.Equal(t, uint64(len(graphCases)), cache.Stats().Hits)
+}
+
+func TestPreloadGraphTags(t *testing.T) {
+	db, cache := newGraphDB(t, gormcache.NewMemoryClient(), gormcache.CacheConfig{TTL: time.Minute, Preloads: true})
+	find := func() (customers []graphCustomer) {
+		require.NoError(t, db.WithContext(cacheCtx()).Preload("Orders.Items").Order("id").Find(&customers).Error)
+		return customers
+	}
+
+	assert.Equal(t, "apple", find()[0].Orders[0].Items[0].Name)
+	require.NoError(t, db.Exec("UPDATE graph_items SET name = ?", "changed").Error)
+	assert.Equal(t, "apple", find()[0].Orders[0].Items[0].Name)
+
+	// dropped with any table of the graph
+	require.NoError(t, cache.PurgeTable(context.Background(), "graph_items"))
+	assert.Equal(t, "changed", find()[0].Orders[0].Items[0].Name)
+}
+
+func TestPreloadGraphGenerations(t *testing.T) {
+	db, _ := newGraphDB(t, newMockCacheClient(), gormcache.CacheConfig{TTL: time.Minute, Preloads: true, Generations: true})
+	find := func() (customers []graphCustomer) {
+		require.NoError(t, db.WithContext(cacheCtx()).Preload("Orders.Items").Order("id").Find(&customers).Error)
+		return customers
+	}
+
+	assert.Len(t, find()[0].Orders[0].Items, 2)
+	require.NoError(t, db.Create(&graphItem{ID: 4, OrderID: 1, Name: "plum"}).Error)
+	assert.Len(t, find()[0].Orders[0].Items, 3)
+}
+
+// TestPreloadEntries checks that a graph is one entry, while without
+// Preloads the root query and each preload query get their own, and a
+// condition the key cannot hold leaves its level out of the graph
+func TestPreloadEntries(t *testing.T) {
+	paid := func(tx *gorm.DB) *gorm.DB { return tx.Where("state = ?", "paid") }
+	cases := []struct {
+		name    string
+		config  gormcache.CacheConfig
+		query   func(db *gorm.DB) *gorm.DB
+		entries int
+	}{
+		{"graph", gormcache.CacheConfig{TTL: time.Minute, Preloads: true}, func(db *gorm.DB) *gorm.DB {
+			return db.Preload("Orders", "state = ?", "paid").Preload("Orders.Items")
+		}, 1},
+		{"default", gormcache.CacheConfig{TTL: time.Minute}, func(db *gorm.DB) *gorm.DB {
+			return db.Preload("Orders", "state = ?", "paid").Preload("Orders.Items")
+		}, 3},
+		{"function", gormcache.CacheConfig{TTL: time.Minute, Preloads: true}, func(db *gorm.DB) *gorm.DB {
+			return db.Preload("Orders", paid).Preload("Orders.Items")
+		}, 2}, // the orders query is a graph of its own, with the items
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := gormcache.NewMemoryClient()
+			db, _ := newGraphDB(t, client, c.config)
+			var want, got []graphCustomer
+			require.NoError(t, c.query(db).Order("id").Find(&want).Error)
+			for i := 0; i < 2; i++ {
+				require.NoError(t, c.query(db.WithContext(cacheCtx())).Order("id").Find(&got).Error)
+				assert.Equal(t, want, got)
+			}
+			assert.Len(t, keysWith(t, client, ""), c.entries)
+		})
+	}
+}
+
+func TestPreloadGraphConditionKeys(t *testing.T) {
+	client := gormcache.NewMemoryClient()
+	db, _ := newGraphDB(t, client, gormcache.CacheConfig{TTL: time.Minute, Preloads: true})
+
+	// conditions printing alike must not share an entry
+	for _, cond := range []interface{}{-1, -2, "-1", int64(-1), 1.5} {
+		var customers []graphCustomer
+		require.NoError(t, db.WithContext(cacheCtx()).Preload("Orders", "id <> ?", cond).Order("id").Find(&customers).Error)
+	}
+	assert.Len(t, keysWith(t, client, ""), 4) // -1 and int64(-1) are the same value
+}
@@ -0,0 +1,203 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// EntryInfo describes a cache entry
+type EntryInfo struct {
+	Key    string          `json:"key"`
+	Size   int             `json:"size"`            // bytes stored
+	TTL    time.Duration   `json:"ttl"`             // time to live left, 0 when it never expires
+	HasTTL bool            `json:"has_ttl"`         // false when the backend cannot tell the TTL
+	Value  json.RawMessage `json:"value,omitempty"` // the stored payload
+	Meta   *EntryMeta      `json:"meta,omitempty"`  // the query behind the entry, when stored with metadata
+
+	Version    int       `json:"version"`              // envelope format version, 0 for header-less JSON
+	Serializer uint8     `json:"serializer"`           // serializer ID of the payload
+	Compressed bool      `json:"compressed,omitempty"` // payload is stored gzip compressed
+	Columns    bool      `json:"columns,omitempty"`    // payload is a column result set
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`  // expiry recorded in the entry, if any
+}
+
+// ErrNotFound is returned by Lookup when the key is not cached
+var ErrNotFound = errors.New("gormcache: key not found")
+
+// ErrOutOfScope is returned by Lookup and the purges when given a key or
+// prefix outside CacheConfig.Prefix, or an empty prefix, so they never
+// reach the keys of other applications sharing the backend
+var ErrOutOfScope = errors.New("gormcache: key outside the cache prefix")
+
+// checkScope returns ErrOutOfScope unless key is a non-empty key or
+// prefix starting with the configured Prefix
+func (g *GormCache) checkScope(key string) error {
+	if key == "" || !strings.HasPrefix(key, g.config.Prefix) {
+		return fmt.Errorf("%w: %q", ErrOutOfScope, key)
+	}
+	return nil
+}
+
+// tagKey returns the backend name of a tag
+func (g *GormCache) tagKey(tag string) string {
+	return g.config.Prefix + "tag:" + tag
+}
+
+// tag associates a freshly stored entry with its tags when the client
+// implements Tagger, so it can be purged by table or tag later
+func (g *GormCache) tag(ctx context.Context, key string, tags []string, ttl time.Duration) {
+	tagger, ok := g.client.(Tagger)
+	if !ok {
+		return
+	}
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = g.tagKey(tag)
+	}
+	if err := tagger.Tag(ctx, key, keys, ttl); err != nil {
+		log.Printf("*** tag cache failed: %v", err)
+	}
+}
+
+// Lookup returns the stored payload of a key with its metadata
+func (g *GormCache) Lookup(ctx context.Context, key string) (*EntryInfo, error) {
+	if err := g.checkScope(key); err != nil {
+		return nil, err
+	}
+	value, err := g.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := value.([]byte)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	entry, err := decodeEntry(data)
+	if err != nil {
+		return nil, err
+	}
+	info := &EntryInfo{
+		Key:        key,
+		Size:       len(data),
+		Value:      entry.Payload,
+		Meta:       entry.Meta,
+		Version:    entry.Version,
+		Serializer: entry.Serializer.ID(),
+		Compressed: entry.Compressed,
+		Columns:    entry.Columns,
+		ExpiresAt:  entry.ExpiresAt,
+	}
+	if !json.Valid(info.Value) {
+		info.Value, _ = json.Marshal(entry.Payload) // not JSON, show it base64 encoded
+	}
+	if !entry.ExpiresAt.IsZero() {
+		info.TTL, info.HasTTL = max(time.Until(entry.ExpiresAt), 0), true
+	}
+	if reader, ok := g.client.(TTLReader); ok {
+		ttl, found, err := reader.TTL(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, ErrNotFound // expired in between
+		}
+		info.TTL, info.HasTTL = ttl, true
+	}
+	return info, nil
+}
+
+// Purge deletes keys from the client and from every local layer
+func (g *GormCache) Purge(ctx context.Context, keys ...string) error {
+	deleter, ok := g.client.(Deleter)
+	if !ok {
+		return fmt.Errorf("%w: Deleter", ErrNotSupported)
+	}
+	for _, key := range keys {
+		if err := g.checkScope(key); err != nil {
+			return err
+		}
+	}
+	if err := deleter.Delete(ctx, keys...); err != nil {
+		return err
+	}
+	return g.Evict(ctx, Invalidation{Keys: keys})
+}
+
+// PurgePrefix deletes every key starting with prefix, returning how many
+// were deleted. The prefix must start with the configured Prefix.
+func (g *GormCache) PurgePrefix(ctx context.Context, prefix string) (int, error) {
+	lister, ok := g.client.(KeyLister)
+	if !ok {
+		return 0, fmt.Errorf("%w: KeyLister", ErrNotSupported)
+	}
+	if err := g.checkScope(prefix); err != nil {
+		return 0, err
+	}
+	keys, err := lister.Keys(ctx, prefix)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	if err = g.Purge(ctx, keys...); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// PurgeTable drops every cached query reading table. It bumps the table
+// generation when Generations is on, deletes the entries tagged with the
+// table when the client implements Tagger, and evicts the local layers.
+func (g *GormCache) PurgeTable(ctx context.Context, table string) error {
+	_, tagger := g.client.(Tagger)
+	if !g.config.Generations && !tagger {
+		return fmt.Errorf("%w: Tagger", ErrNotSupported)
+	}
+	if g.config.Generations {
+		if err := g.InvalidateTables(ctx, table); err != nil {
+			return err
+		}
+	}
+	if tagger {
+		if err := g.client.(Tagger).DeleteTags(ctx, g.tagKey(TableTag(table))); err != nil {
+			return err
+		}
+	}
+	return g.Evict(ctx, Invalidation{Tables: []string{table}})
+}
+
+// PurgeTags deletes every entry carrying one of tags
+func (g *GormCache) PurgeTags(ctx context.Context, tags ...string) error {
+	tagger, ok := g.client.(Tagger)
+	if !ok {
+		return fmt.Errorf("%w: Tagger", ErrNotSupported)
+	}
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = g.tagKey(tag)
+	}
+	if err := tagger.DeleteTags(ctx, keys...); err != nil {
+		return err
+	}
+	return g.Evict(ctx, Invalidation{Tags: tags})
+}
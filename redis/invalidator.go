@@ -0,0 +1,102 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcacheredis
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+	gormcache "github.com/rgglez/gormcache"
+)
+
+// reconnectDelay is how long Run waits after a subscription error before
+// receiving again
+const reconnectDelay = time.Second
+
+// Invalidator broadcasts cache invalidations over a Redis pub/sub channel.
+// Set it as CacheConfig.Broadcaster to publish the evictions of a
+// GormCache, and call Run to apply the evictions published by others.
+type Invalidator struct {
+	client  *redis.Client
+	channel string
+}
+
+// NewInvalidator returns a new Invalidator instance publishing on channel
+func NewInvalidator(client *redis.Client, channel string) *Invalidator {
+	return &Invalidator{
+		client:  client,
+		channel: channel,
+	}
+}
+
+// Publish publishes an invalidation on the channel
+func (i *Invalidator) Publish(ctx context.Context, inv gormcache.Invalidation) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return i.client.Publish(ctx, i.channel, data).Err()
+}
+
+// Run subscribes to the channel and evicts the local layer of cache for
+// every invalidation received, until ctx is done. The client reconnects
+// after connection errors; as invalidations published in the meantime are
+// lost, the whole local layer is flushed once the subscription is back.
+func (i *Invalidator) Run(ctx context.Context, cache *gormcache.GormCache) error {
+	pubsub := i.client.Subscribe(ctx, i.channel)
+	defer pubsub.Close()
+
+	gap := false
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("*** invalidation subscription failed: %v", err)
+			gap = true
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(reconnectDelay):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" && gap {
+				if err := cache.EvictLocal(ctx, gormcache.Invalidation{Flush: true}); err != nil {
+					log.Printf("*** flush local cache failed: %v", err)
+				}
+				gap = false
+			}
+		case *redis.Message:
+			var inv gormcache.Invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				log.Printf("*** decode invalidation failed: %v", err)
+				continue
+			}
+			if err := cache.EvictLocal(ctx, inv); err != nil {
+				log.Printf("*** evict local cache failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcacheredis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	gormcacheredis "github.com/rgglez/gormcache/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidator(t *testing.T) {
+	if rdb == nil {
+		t.Skip("DB_HOST not set, skipping integration test")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local := gormcache.NewMemoryClient()
+	require.NoError(t, local.Set(ctx, "cache:k1", "v1", 0))
+	require.NoError(t, local.Set(ctx, "cache:k2", "v2", 0))
+	require.NoError(t, local.Tag(ctx, "cache:k2", []string{gormcache.TableTag("users")}, 0))
+
+	inv := gormcacheredis.NewInvalidator(rdb, "gormcache:test:invalidate")
+	cache := gormcache.NewGormCache("my_cache", gormcacheredis.NewRedisClient(rdb), gormcache.CacheConfig{
+		Local:       local,
+		Broadcaster: inv,
+	})
+	go inv.Run(ctx, cache)
+	time.Sleep(100 * time.Millisecond) // let the subscription start
+
+	require.NoError(t, inv.Publish(ctx, gormcache.Invalidation{Keys: []string{"cache:k1"}}))
+	require.NoError(t, inv.Publish(ctx, gormcache.Invalidation{Tables: []string{"users"}}))
+	assert.Eventually(t, func() bool { return local.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -22,6 +22,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	redis "github.com/redis/go-redis/v9"
@@ -52,11 +53,144 @@ func (r *RedisClient) Get(ctx context.Context, key string) (interface{}, error)
 	return data, nil
 }
 
-// Set sets value to redis by key with ttl using json encoding/decoding
-func (r *RedisClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
-	data, err := json.Marshal(value) // encode value to json bytes using json encoding/decoding
+// GetMulti gets the values of keys from redis with one MGET, nil for
+// missing keys
+func (r *RedisClient) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	values, err := r.client.MGet(ctx, keys...).Result()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			values[i] = []byte(s)
+		}
+	}
+	return values, nil
+}
+
+// Set sets value to redis by key with ttl, []byte values as they are and
+// anything else using json encoding
+func (r *RedisClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, ok := value.([]byte) // encoded entries are stored verbatim
+	if !ok {
+		var err error
+		if data, err = json.Marshal(value); err != nil { // encode value to json bytes using json encoding/decoding
+			return err
+		}
 	}
 	return r.client.Set(ctx, key, data, ttl).Err()
 }
+
+// Incr atomically increments the counter stored at key
+func (r *RedisClient) Incr(ctx context.Context, key string) (int64, error) {
+	return r.client.Incr(ctx, key).Result()
+}
+
+// deleteBatch is the maximum number of keys sent in one DEL
+const deleteBatch = 1000
+
+// Delete deletes keys from redis
+func (r *RedisClient) Delete(ctx context.Context, keys ...string) error {
+	for len(keys) > 0 {
+		n := min(len(keys), deleteBatch)
+		if err := r.client.Del(ctx, keys[:n]...).Err(); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// TTL returns the remaining time to live of key
+func (r *RedisClient) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	ttl, err := r.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	switch ttl {
+	case -2: // key does not exist
+		return 0, false, nil
+	case -1: // key never expires
+		return 0, true, nil
+	}
+	return ttl, true, nil
+}
+
+// Keys lists the keys starting with prefix using SCAN
+func (r *RedisClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, escapeGlob(prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// TaggedRedisClient is a RedisClient that also implements
+// gormcache.Tagger, so PurgeTable and PurgeTags can delete entries. Every
+// entry stored then costs one more round trip to tag it.
+type TaggedRedisClient struct {
+	*RedisClient
+}
+
+// NewTaggedRedisClient returns a new TaggedRedisClient instance
+func NewTaggedRedisClient(client *redis.Client) *TaggedRedisClient {
+	return &TaggedRedisClient{RedisClient: NewRedisClient(client)}
+}
+
+// tagScript adds ARGV[1] to the tag KEYS[1], a sorted set scored by the
+// expiry of its members in Unix milliseconds (ARGV[2], 0 when it never
+// expires). It drops the members expired by ARGV[3], the current time, and
+// makes the set expire with its longest lived member, with commands every
+// Redis version has.
+var tagScript = redis.NewScript(`
+local score = ARGV[2]
+if score == '0' then score = '+inf' end
+redis.call('ZADD', KEYS[1], score, ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+if last[2] == nil then
+	return 0
+elseif last[2] == 'inf' then
+	redis.call('PERSIST', KEYS[1])
+else
+	redis.call('PEXPIREAT', KEYS[1], last[2])
+end
+return 1
+`)
+
+// Tag adds key to every tag set, dropping the members that expired
+func (r *TaggedRedisClient) Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixMilli()
+	}
+	pipe := r.client.Pipeline()
+	for _, tag := range tags {
+		tagScript.Eval(ctx, pipe, []string{tag}, key, expires, now.UnixMilli())
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DeleteTags deletes the members of every tag set and the sets themselves
+func (r *TaggedRedisClient) DeleteTags(ctx context.Context, tags ...string) error {
+	for _, tag := range tags {
+		keys, err := r.client.ZRange(ctx, tag, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		if err = r.Delete(ctx, append(keys, tag)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeGlob escapes the glob metacharacters of a SCAN pattern
+func escapeGlob(s string) string {
+	return globEscaper.Replace(s)
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
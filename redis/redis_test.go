@@ -130,3 +130,42 @@ func BenchmarkRedisCache(b *testing.B) {
 		dbRedis.Session(&gorm.Session{Context: context.WithValue(context.Background(), gormcache.UseCacheKey, true)}).Where("id > ?", 10).Find(&users)
 	}
 }
+
+func TestTaggedRedisClient(t *testing.T) {
+	if rdb == nil {
+		t.Skip("DB_HOST not set, skipping integration test")
+	}
+	ctx := context.Background()
+	client := gormcacheredis.NewTaggedRedisClient(rdb)
+	tag := "gormcache:test:tag"
+	rdb.Del(ctx, tag, "gormcache:test:k1", "gormcache:test:k2")
+
+	// members expired are dropped when the next one is added
+	assert.NoError(t, client.Set(ctx, "gormcache:test:k1", []byte("1"), 50*time.Millisecond))
+	assert.NoError(t, client.Tag(ctx, "gormcache:test:k1", []string{tag}, 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, client.Set(ctx, "gormcache:test:k2", []byte("2"), time.Minute))
+	assert.NoError(t, client.Tag(ctx, "gormcache:test:k2", []string{tag}, time.Minute))
+	members, err := rdb.ZRange(ctx, tag, 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gormcache:test:k2"}, members)
+
+	// the set lives as long as its longest lived member
+	ttl, err := rdb.PTTL(ctx, tag).Result()
+	assert.NoError(t, err)
+	assert.Greater(t, ttl, 50*time.Second)
+
+	assert.NoError(t, client.DeleteTags(ctx, tag))
+	assert.Equal(t, int64(0), rdb.Exists(ctx, tag, "gormcache:test:k2").Val())
+}
+
+func TestTaggingIsOptIn(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"}) // never dialed
+	defer client.Close()
+
+	var plain, tagged gormcache.CacheClient = gormcacheredis.NewRedisClient(client), gormcacheredis.NewTaggedRedisClient(client)
+	_, ok := plain.(gormcache.Tagger)
+	assert.False(t, ok)
+	_, ok = tagged.(gormcache.Tagger)
+	assert.True(t, ok)
+}
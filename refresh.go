@@ -0,0 +1,202 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// refreshSweepInterval is how often expired entries are dropped from the
+// refresh-ahead bookkeeping
+const refreshSweepInterval = time.Minute
+
+// refreshEntry is what refresh-ahead remembers about a cached query
+type refreshEntry struct {
+	sql        string
+	vars       []interface{}
+	tables     []string
+	tags       []string // table tags and CacheTagsKey tags, set again on every refresh
+	destType   reflect.Type
+	columns    bool // the query was read as column values, not scanned
+	pool       gorm.ConnPool
+	ttl        time.Duration
+	created    time.Time
+	hits       int
+	refreshing bool
+}
+
+// refresher keeps the access count and insertion time of cached queries
+type refresher struct {
+	mu        sync.Mutex
+	entries   map[string]*refreshEntry
+	lastSweep time.Time
+}
+
+func newRefresher() *refresher {
+	return &refresher{entries: make(map[string]*refreshEntry), lastSweep: time.Now()}
+}
+
+// record remembers a freshly stored entry
+func (r *refresher) record(key string, db *gorm.DB, ttl time.Duration) {
+	if ttl <= 0 || db.Statement.Dest == nil || inTransaction(db) {
+		return
+	}
+	vars := make([]interface{}, len(db.Statement.Vars))
+	copy(vars, db.Statement.Vars)
+	value, _ := db.InstanceGet(columnsKey)
+	rs, _ := value.(*resultSet)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.entries[key] = &refreshEntry{
+		sql:      db.Statement.SQL.String(),
+		vars:     vars,
+		tables:   queryTables(db),
+		tags:     entryTags(db),
+		destType: reflect.TypeOf(db.Statement.Dest),
+		columns:  rs != nil,
+		pool:     db.Statement.ConnPool,
+		ttl:      ttl,
+		created:  now,
+	}
+	if now.Sub(r.lastSweep) >= refreshSweepInterval {
+		for k, e := range r.entries {
+			if now.Sub(e.created) >= e.ttl && !e.refreshing {
+				delete(r.entries, k)
+			}
+		}
+		r.lastSweep = now
+	}
+}
+
+// touch counts a cache hit and returns the entry when it is due for a
+// refresh, marking it as being refreshed
+func (r *refresher) touch(key string, fraction float64, minHits int) *refreshEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[key]
+	if !ok || e.refreshing {
+		return nil
+	}
+	e.hits++
+	age := time.Since(e.created)
+	if age >= e.ttl {
+		delete(r.entries, key)
+		return nil
+	}
+	if e.hits < minHits || age < e.ttl-time.Duration(float64(e.ttl)*fraction) {
+		return nil
+	}
+	e.refreshing = true
+	return e
+}
+
+// done resets an entry after a refresh attempt
+func (r *refresher) done(key string, e *refreshEntry, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.refreshing = false
+	if ok {
+		e.created = time.Now()
+		e.hits = 0
+	}
+}
+
+// refreshAhead refreshes the entry of a cache hit in the background when
+// the hit happens close enough to the end of its TTL
+func (g *GormCache) refreshAhead(key string) {
+	if g.config.RefreshAhead <= 0 {
+		return
+	}
+	e := g.refresher.touch(key, g.config.RefreshAhead, g.config.RefreshAheadHits)
+	if e == nil {
+		return
+	}
+	go func() {
+		err := g.refresh(key, e)
+		if err != nil {
+			log.Printf("*** refresh ahead failed, key: %v, err: %v", key, err)
+		}
+		g.refresher.done(key, e, err == nil)
+	}()
+}
+
+// refresh re-runs the stored SQL and overwrites the entry in the format it
+// was stored in. It gives up after a TTL, so a hung database does not hold
+// the refresh forever.
+func (g *GormCache) refresh(key string, e *refreshEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl)
+	defer cancel()
+	dest := reflect.New(e.destType.Elem()).Interface()
+
+	tx := g.db.Session(&gorm.Session{NewDB: true, Context: ctx})
+	tx.Statement.Dest = dest
+	tx.Statement.ReflectValue = reflect.ValueOf(dest).Elem()
+	if err := tx.Statement.Parse(dest); err != nil {
+		tx.Statement.Schema = nil // not a model, e.g. a map destination
+	}
+
+	rows, err := e.pool.QueryContext(ctx, e.sql, e.vars...)
+	if err != nil {
+		return err
+	}
+	var rs *resultSet
+	if e.columns {
+		if rs, err = readResultSet(rows); err == nil {
+			replay(tx, rs)
+		}
+	} else {
+		gorm.Scan(rows, tx, 0)
+	}
+	if cerr := rows.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if g.tooManyRows(key, tx.RowsAffected) {
+		return nil // the old entry ages out
+	}
+	var meta *EntryMeta
+	if g.config.Metadata {
+		meta = g.newMeta(tx, e.sql, e.vars, e.tables, tx.RowsAffected, dest, e.ttl)
+	}
+	var payload []byte
+	if rs != nil && !compactScalar(tx.Statement.ReflectValue, tx.RowsAffected) {
+		payload, err = g.encodeColumns(meta, rs, e.ttl)
+	} else {
+		payload, err = g.encodeEntry(meta, result(dest, tx.Statement.ReflectValue, tx.RowsAffected), e.ttl)
+	}
+	if err != nil {
+		return err
+	}
+	if g.tooLarge(key, payload) {
+		return nil
+	}
+	// tagged again, a Set drops the tags of the key or leaves their old expiry
+	return g.store(ctx, key, payload, e.tags, e.ttl)
+}
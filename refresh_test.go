@@ -0,0 +1,179 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestRefreshAhead(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("refresh_cache", client, gormcache.CacheConfig{
+		TTL:              200 * time.Millisecond,
+		Prefix:           "refresh:",
+		RefreshAhead:     0.5,
+		RefreshAheadHits: 2,
+	})
+	require.NoError(t, db.Use(cache))
+
+	names := func() []string {
+		var users []testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Order("id").Find(&users).Error)
+		out := make([]string, len(users))
+		for i, u := range users {
+			out[i] = u.Name
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"user1", "user2", "user3"}, names())
+	require.NoError(t, db.Exec("UPDATE test_users SET name = 'renamed' WHERE id = 1").Error)
+
+	// early reads are served from cache and do not refresh
+	assert.Equal(t, "user1", names()[0])
+	assert.Equal(t, "user1", names()[0])
+	sets := func() int {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.sets
+	}
+	assert.Equal(t, 1, sets())
+
+	// reads near the end of the TTL refresh the entry in the background
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, "user1", names()[0])
+	assert.Eventually(t, func() bool { return sets() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "renamed", names()[0])
+}
+
+func TestRefreshAheadKeepsFormat(t *testing.T) {
+	db := newTestDB(t, 3)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("refresh_cache", client, gormcache.CacheConfig{
+		TTL:          200 * time.Millisecond,
+		RefreshAhead: 0.5,
+		Columns:      true,
+		Entities:     true,
+	})
+	require.NoError(t, db.Use(cache))
+	cdb := db.Session(&gorm.Session{Context: cacheCtx()})
+	sets := func() int {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.sets
+	}
+
+	require.NoError(t, cdb.First(&testUser{}, 1).Error)
+	require.NoError(t, db.Exec("UPDATE test_users SET name = 'renamed' WHERE id = 1").Error)
+	time.Sleep(120 * time.Millisecond)
+	require.NoError(t, cdb.First(&testUser{}, 1).Error)
+	require.Eventually(t, func() bool { return sets() == 2 }, time.Second, 5*time.Millisecond)
+
+	// still an entity, not a column entry
+	info, err := cache.Lookup(context.Background(), "entity:test_users:1")
+	require.NoError(t, err)
+	assert.False(t, info.Columns)
+	assert.JSONEq(t, `{"ID":1,"Name":"renamed"}`, string(info.Value))
+}
+
+func TestRefreshAheadKeepsTags(t *testing.T) {
+	db := newTestDB(t, 3)
+	client, local := gormcache.NewMemoryClient(), gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("refresh_cache", client, gormcache.CacheConfig{
+		TTL:          200 * time.Millisecond,
+		RefreshAhead: 0.5,
+		Local:        local,
+	})
+	require.NoError(t, db.Use(cache))
+	ctx := context.WithValue(cacheCtx(), gormcache.CacheTagsKey, []string{"report"})
+	names := func() (users []testUser) {
+		require.NoError(t, db.WithContext(ctx).Order("id").Find(&users).Error)
+		return users
+	}
+
+	names()
+	key := onlyKey(t, client)
+	require.NoError(t, db.Exec("UPDATE test_users SET name = 'renamed' WHERE id = 1").Error)
+	time.Sleep(120 * time.Millisecond)
+	names()
+	require.Eventually(t, func() bool {
+		info, err := cache.Lookup(context.Background(), key)
+		return err == nil && strings.Contains(string(info.Value), "renamed")
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "renamed", names()[0].Name, "the local layer holds the refreshed entry")
+
+	// the refreshed entry is still tagged, in the client and locally
+	require.NoError(t, cache.PurgeTable(context.Background(), "test_users"))
+	assert.Equal(t, 0, client.Len())
+	assert.Equal(t, 0, local.Len())
+	names()
+	require.NoError(t, cache.PurgeTags(context.Background(), "report"))
+	assert.Equal(t, 0, client.Len())
+}
+
+// hangingPool is a connection pool whose queries block until their
+// context is done while hang is set
+type hangingPool struct {
+	gorm.ConnPool
+	hang     atomic.Bool
+	released chan error
+}
+
+func (p *hangingPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if p.hang.Load() {
+		<-ctx.Done()
+		p.released <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	return p.ConnPool.QueryContext(ctx, query, args...)
+}
+
+func TestRefreshAheadDeadline(t *testing.T) {
+	db := newTestDB(t, 1)
+	pool := &hangingPool{ConnPool: db.ConnPool, released: make(chan error, 1)}
+	db.ConnPool, db.Statement.ConnPool = pool, pool
+	cache := gormcache.NewGormCache("refresh_cache", newMockCacheClient(), gormcache.CacheConfig{
+		TTL:          100 * time.Millisecond,
+		RefreshAhead: 1, // every hit refreshes
+	})
+	require.NoError(t, db.Use(cache))
+
+	find := func() {
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Find(&[]testUser{}).Error)
+	}
+	find()
+	pool.hang.Store(true)
+	find() // a hit, refreshed against a hung database
+
+	select {
+	case err := <-pool.released:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh still waiting on the database")
+	}
+}
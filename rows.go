@@ -0,0 +1,176 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+)
+
+// rowsKey returns the key of the result set of a Row or Rows query,
+// distinct from the key of the same SQL run through Find and after the
+// same prefix and scope
+func rowsKey(prefix, key string) string {
+	return prefix + "rows:" + strings.TrimPrefix(key, prefix)
+}
+
+// rowCallback replaces gorm:row, behind Row, Rows and Raw().Scan. A
+// cached query is read whole into a result set, stored, and handed to the
+// caller as *sql.Row or *sql.Rows served from memory.
+func (g *GormCache) rowCallback(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	enableCache, adaptive := g.enableCache(db)
+	callbacks.BuildQuerySQL(db)
+	if db.DryRun || db.Error != nil {
+		return
+	}
+
+	if g.config.Preloads {
+		db.InstanceSet(graphKey, (*graphQuery)(nil)) // preloads do not apply to rows
+	}
+	fingerprint := db.Statement.SQL.String()
+	if adaptive {
+		enableCache = g.latency.slow(fingerprint, g.adaptiveThreshold())
+	}
+	if !enableCache || inTransaction(db) {
+		start := time.Now()
+		callbacks.RowQuery(db)
+		if g.config.Adaptive && db.Error == nil {
+			g.latency.observe(fingerprint, time.Since(start))
+		}
+		return
+	}
+
+	key, err := g.cacheKey(db)
+	if err != nil {
+		log.Printf("*** build cache key failed, err: '%v'", err)
+		callbacks.RowQuery(db)
+		return
+	}
+	prefix, _ := g.keyPrefix(db) // Prefix alone for generators that are not KeyScopers
+	key = rowsKey(prefix, key)
+
+	if !refreshing(db) && !g.sessionWrote(db) {
+		rs, err := g.loadRows(db, key)
+		if err != nil {
+			g.counters.errors.Add(1)
+			log.Printf("*** load cache failed, err: '%v'", err)
+		}
+		if rs != nil {
+			g.counters.hits.Add(1)
+			if g.config.Adaptive {
+				g.latency.hit(fingerprint)
+			}
+			serveRows(db, rs)
+			return
+		}
+		g.counters.misses.Add(1)
+	}
+
+	start := time.Now()
+	rs, err := g.queryRows(db)
+	if err != nil {
+		serveRows(db, err)
+		return
+	}
+	if g.config.Adaptive {
+		g.latency.observe(fingerprint, time.Since(start))
+	}
+	if err = g.setRows(db, key, rs); err != nil {
+		g.counters.errors.Add(1)
+		log.Printf("*** set cache failed: %v", err)
+	}
+	serveRows(db, rs)
+}
+
+// loadRows returns the result set stored under key, nil on a miss
+func (g *GormCache) loadRows(db *gorm.DB, key string) (*resultSet, error) {
+	value, err := g.get(db, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	entry, err := decodeEntry(value.([]byte))
+	if err != nil {
+		return nil, err
+	}
+	if entry.expired(time.Now()) || !entry.Columns {
+		return nil, nil
+	}
+	return decodeColumns(entry)
+}
+
+// queryRows runs the query of db and reads its whole result
+func (g *GormCache) queryRows(db *gorm.DB) (*resultSet, error) {
+	rows, err := db.Statement.ConnPool.QueryContext(db.Statement.Context, db.Statement.SQL.String(), db.Statement.Vars...)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := readResultSet(rows)
+	if closeErr := rows.Close(); err == nil {
+		err = closeErr
+	}
+	return rs, err
+}
+
+// setRows stores a result set under key in a column entry
+func (g *GormCache) setRows(db *gorm.DB, key string, rs *resultSet) error {
+	if g.tooManyRows(key, int64(len(rs.Rows))) {
+		return nil
+	}
+	ctx, ttl := db.Statement.Context, g.ttl(db)
+	var meta *EntryMeta
+	if g.config.Metadata {
+		meta = g.newMeta(db, db.Statement.SQL.String(), db.Statement.Vars, queryTables(db), int64(len(rs.Rows)), (*sql.Rows)(nil), ttl)
+	}
+	payload, err := g.encodeColumns(meta, rs, ttl)
+	if err != nil {
+		return err
+	}
+	if g.tooLarge(key, payload) {
+		return nil
+	}
+	if err = g.store(ctx, key, payload, entryTags(db), ttl); err != nil {
+		return err
+	}
+	if g.config.Adaptive {
+		g.latency.stored(db.Statement.SQL.String(), len(payload))
+	}
+	return nil
+}
+
+// serveRows sets the destination of a Row or Rows query to the rows of
+// result, a *resultSet, or to an error, as gorm:row does with the
+// database ones
+func serveRows(db *gorm.DB, result interface{}) {
+	ctx := context.WithoutCancel(db.Statement.Context)
+	if isRows, ok := db.Get("rows"); ok && isRows.(bool) {
+		db.Statement.Settings.Delete("rows")
+		db.Statement.Dest, db.Error = replayPool().QueryContext(ctx, "", result)
+	} else {
+		db.Statement.Dest = replayPool().QueryRowContext(ctx, "", result)
+	}
+	db.RowsAffected = -1
+}
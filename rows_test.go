@@ -0,0 +1,131 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newRowsCache(t *testing.T, db *gorm.DB) (*gormcache.GormCache, *gormcache.MemoryClient) {
+	t.Helper()
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("rows_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+	return cache, client
+}
+
+func TestRawScanCached(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, _ := newRowsCache(t, db)
+
+	for i := 0; i < 2; i++ {
+		var dtos []userDTO
+		tx := db.WithContext(cacheCtx()).Raw("SELECT id, name FROM test_users WHERE id > ? ORDER BY id", 1).Scan(&dtos)
+		require.NoError(t, tx.Error)
+		assert.Equal(t, []userDTO{{ID: 2, Name: "user2"}, {ID: 3, Name: "user3"}}, dtos)
+		assert.Equal(t, int64(2), tx.RowsAffected)
+
+		var name string
+		require.NoError(t, db.WithContext(cacheCtx()).Raw("SELECT name FROM test_users WHERE id = ?", 3).Scan(&name).Error)
+		assert.Equal(t, "user3", name)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 2, Misses: 2, Sets: 2}, cache.Stats())
+}
+
+func TestRowCached(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, _ := newRowsCache(t, db)
+
+	for i := 0; i < 2; i++ {
+		var id int
+		var name string
+		row := db.WithContext(cacheCtx()).Model(&testUser{}).Select("id, name").Where("id = ?", 2).Row()
+		require.NoError(t, row.Scan(&id, &name))
+		assert.Equal(t, 2, id)
+		assert.Equal(t, "user2", name)
+
+		row = db.WithContext(cacheCtx()).Model(&testUser{}).Select("id").Where("id = ?", 100).Row()
+		assert.ErrorIs(t, row.Scan(&id), sql.ErrNoRows)
+	}
+	assert.Equal(t, gormcache.Stats{Hits: 2, Misses: 2, Sets: 2}, cache.Stats())
+}
+
+func TestRowsCached(t *testing.T) {
+	db := newTestDB(t, 3)
+	cache, _ := newRowsCache(t, db)
+
+	read := func(ctx context.Context) (users []testUser) {
+		rows, err := db.WithContext(ctx).Model(&testUser{}).Order("id").Rows()
+		require.NoError(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			var user testUser
+			require.NoError(t, db.ScanRows(rows, &user))
+			users = append(users, user)
+		}
+		require.NoError(t, rows.Err())
+		return users
+	}
+
+	want := read(context.Background())
+	assert.Len(t, want, 3)
+	assert.Equal(t, want, read(cacheCtx()))
+	assert.Equal(t, want, read(cacheCtx()))
+	assert.Equal(t, gormcache.Stats{Hits: 1, Misses: 1, Sets: 1}, cache.Stats())
+
+	// the entry is tagged with its table
+	require.NoError(t, cache.PurgeTable(context.Background(), "test_users"))
+	require.NoError(t, db.Create(&testUser{ID: 4, Name: "user4"}).Error)
+	assert.Len(t, read(cacheCtx()), 4)
+}
+
+func TestRowErrors(t *testing.T) {
+	db := newTestDB(t, 1)
+	cache, client := newRowsCache(t, db)
+
+	var id int
+	row := db.WithContext(cacheCtx()).Raw("SELECT id FROM missing_table").Row()
+	assert.Error(t, row.Scan(&id))
+
+	_, err := db.WithContext(cacheCtx()).Raw("SELECT id FROM missing_table").Rows()
+	assert.Error(t, err)
+
+	keys, err := client.Keys(context.Background(), "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Zero(t, cache.Stats().Sets)
+}
+
+func TestRowsSeparateFromFind(t *testing.T) {
+	db := newTestDB(t, 2)
+	cache := gormcache.NewGormCache("rows_cache", gormcache.NewMemoryClient(), gormcache.CacheConfig{TTL: time.Minute, Metadata: true})
+	require.NoError(t, db.Use(cache))
+
+	var found, scanned []testUser
+	require.NoError(t, db.WithContext(cacheCtx()).Raw("SELECT * FROM test_users").Find(&found).Error)
+	require.NoError(t, db.WithContext(cacheCtx()).Raw("SELECT * FROM test_users").Scan(&scanned).Error)
+	assert.Equal(t, found, scanned)
+	assert.Equal(t, gormcache.Stats{Misses: 2, Sets: 2}, cache.Stats())
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type cacheSessionKey struct{}
+
+// CacheSessionKey is the context key of the session token, a string
+// identifying the user or client whose writes must be visible to its own
+// subsequent reads
+var CacheSessionKey cacheSessionKey
+
+// SessionStore records which tables a session wrote recently
+type SessionStore interface {
+	// MarkWritten records that session wrote table, for window
+	MarkWritten(ctx context.Context, session, table string, window time.Duration) error
+	// Written reports whether session wrote table within the window
+	Written(ctx context.Context, session, table string) (bool, error)
+}
+
+// sessionSweepInterval is how often expired windows are dropped from the
+// memory session store
+const sessionSweepInterval = time.Minute
+
+// memorySessionStore keeps the session writes in process memory
+type memorySessionStore struct {
+	mu        sync.Mutex
+	written   map[string]time.Time // session + table -> end of window
+	lastSweep time.Time
+}
+
+// NewMemorySessionStore returns a SessionStore local to the process. It is
+// the default, and only works when the same replica serves the session.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{written: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// MarkWritten records that session wrote table
+func (m *memorySessionStore) MarkWritten(ctx context.Context, session, table string, window time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastSweep) >= sessionSweepInterval {
+		for k, until := range m.written {
+			if now.After(until) {
+				delete(m.written, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.written[session+"\x00"+table] = now.Add(window)
+	return nil
+}
+
+// Written reports whether session wrote table within the window
+func (m *memorySessionStore) Written(ctx context.Context, session, table string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := session + "\x00" + table
+	until, ok := m.written[key]
+	if ok && !time.Now().Before(until) {
+		delete(m.written, key)
+		return false, nil
+	}
+	return ok, nil
+}
+
+// backendSessionStore keeps the session writes in a cache backend, as
+// keys expiring at the end of the window
+type backendSessionStore struct {
+	client CacheClient
+	prefix string
+}
+
+// NewBackendSessionStore returns a SessionStore keeping the session writes
+// in client under prefix, so every replica sharing the backend sees them.
+// The backend must honor TTLs.
+func NewBackendSessionStore(client CacheClient, prefix string) SessionStore {
+	return &backendSessionStore{client: client, prefix: prefix}
+}
+
+func (b *backendSessionStore) key(session, table string) string {
+	return b.prefix + "session:" + session + ":" + table
+}
+
+// MarkWritten records that session wrote table
+func (b *backendSessionStore) MarkWritten(ctx context.Context, session, table string, window time.Duration) error {
+	return b.client.Set(ctx, b.key(session, table), storable([]byte("1")), window)
+}
+
+// Written reports whether session wrote table within the window
+func (b *backendSessionStore) Written(ctx context.Context, session, table string) (bool, error) {
+	value, err := b.client.Get(ctx, b.key(session, table))
+	return value != nil, err
+}
+
+// session returns the session token carried by the statement context
+func session(db *gorm.DB) string {
+	token, _ := db.Statement.Context.Value(CacheSessionKey).(string)
+	return token
+}
+
+// sessionCallback records the table written by a create, update or
+// delete statement in the session of the context
+func (g *GormCache) sessionCallback(db *gorm.DB) {
+	token := session(db)
+	if db.Error != nil || db.DryRun || token == "" || db.Statement.Table == "" {
+		return
+	}
+	if err := g.config.SessionStore.MarkWritten(db.Statement.Context, token, db.Statement.Table, g.config.SessionWindow); err != nil {
+		log.Printf("*** mark session write failed: %v", err)
+	}
+}
+
+// registerSessions registers sessionCallback after every write
+func (g *GormCache) registerSessions(db *gorm.DB) error {
+	if g.config.SessionStore == nil {
+		g.config.SessionStore = NewMemorySessionStore()
+	}
+	if err := db.Callback().Create().After("gorm:create").Register("gormcache:session", g.sessionCallback); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:update").Register("gormcache:session", g.sessionCallback); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("gormcache:session", g.sessionCallback)
+}
+
+// sessionWrote reports whether the session of the context recently wrote
+// one of the tables the query reads, so the cached value may predate it
+func (g *GormCache) sessionWrote(db *gorm.DB) bool {
+	token := session(db)
+	if g.config.SessionWindow <= 0 || token == "" {
+		return false
+	}
+	for _, table := range queryTables(db) {
+		written, err := g.config.SessionStore.Written(db.Statement.Context, token, table)
+		if err != nil {
+			log.Printf("*** read session writes failed: %v", err)
+			return true // be safe and read the database
+		}
+		if written {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	stores := map[string]func(client gormcache.CacheClient) gormcache.SessionStore{
+		"memory": func(gormcache.CacheClient) gormcache.SessionStore { return gormcache.NewMemorySessionStore() },
+		"backend": func(client gormcache.CacheClient) gormcache.SessionStore {
+			return gormcache.NewBackendSessionStore(client, "ryw:")
+		},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t, 2)
+			client := newMockCacheClient()
+			require.NoError(t, db.Use(gormcache.NewGormCache("ryw_cache", client, gormcache.CacheConfig{
+				TTL:           time.Minute,
+				SessionWindow: time.Minute,
+				SessionStore:  store(client),
+			})))
+
+			alice := context.WithValue(cacheCtx(), gormcache.CacheSessionKey, "alice")
+			bob := context.WithValue(cacheCtx(), gormcache.CacheSessionKey, "bob")
+			name := func(ctx context.Context) string {
+				var user testUser
+				require.NoError(t, db.Session(&gorm.Session{Context: ctx}).Where("id = ?", 1).Find(&user).Error)
+				return user.Name
+			}
+
+			assert.Equal(t, "user1", name(alice))
+			require.NoError(t, db.WithContext(alice).Model(&testUser{ID: 1}).Update("name", "alice").Error)
+
+			// bob still reads the cached row, alice sees her own write
+			assert.Equal(t, "user1", name(bob))
+			assert.Equal(t, "alice", name(alice))
+		})
+	}
+}
+
+func TestMemorySessionStoreWindow(t *testing.T) {
+	store := gormcache.NewMemorySessionStore()
+	ctx := context.Background()
+	require.NoError(t, store.MarkWritten(ctx, "alice", "users", 20*time.Millisecond))
+
+	written, err := store.Written(ctx, "alice", "users")
+	require.NoError(t, err)
+	assert.True(t, written)
+	written, _ = store.Written(ctx, "alice", "orders")
+	assert.False(t, written)
+	written, _ = store.Written(ctx, "bob", "users")
+	assert.False(t, written)
+
+	time.Sleep(30 * time.Millisecond)
+	written, _ = store.Written(ctx, "alice", "users")
+	assert.False(t, written)
+}
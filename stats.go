@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import "sync/atomic"
+
+// Stats holds the counters of a GormCache since it was created
+type Stats struct {
+	Hits   uint64 `json:"hits"`   // queries served from the cache
+	Misses uint64 `json:"misses"` // cacheable queries sent to the database
+	Sets   uint64 `json:"sets"`   // entries written
+	Errors uint64 `json:"errors"` // failed cache reads and writes
+	Skips  uint64 `json:"skips"`  // results over MaxRows or MaxEntryBytes, not cached
+}
+
+// counters is the atomic counterpart of Stats
+type counters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	sets   atomic.Uint64
+	errors atomic.Uint64
+	skips  atomic.Uint64
+}
+
+// Stats returns a snapshot of the cache counters
+func (g *GormCache) Stats() Stats {
+	return Stats{
+		Hits:   g.counters.hits.Load(),
+		Misses: g.counters.misses.Load(),
+		Sets:   g.counters.sets.Load(),
+		Errors: g.counters.errors.Load(),
+		Skips:  g.counters.skips.Load(),
+	}
+}
+
+// SetEnabled turns caching on or off for every query, whatever their
+// context says. Caching is enabled by default.
+func (g *GormCache) SetEnabled(enabled bool) {
+	g.disabled.Store(!enabled)
+}
+
+// Enabled reports whether caching is globally enabled
+func (g *GormCache) Enabled() bool {
+	return !g.disabled.Load()
+}
@@ -0,0 +1,246 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// TxPolicy controls how the cache behaves inside a transaction
+type TxPolicy int
+
+const (
+	// TxBypass makes queries inside a transaction skip the cache entirely
+	TxBypass TxPolicy = iota
+	// TxBuffer makes queries inside a transaction skip cache reads, and
+	// holds their cache writes and invalidations until the transaction
+	// commits. Everything buffered is dropped on rollback.
+	TxBuffer
+)
+
+// inTransaction reports whether the statement runs inside a transaction
+func inTransaction(db *gorm.DB) bool {
+	switch db.Statement.ConnPool.(type) {
+	case *sql.Tx, gorm.TxCommitter:
+		return true
+	}
+	return false
+}
+
+// txPool wraps the connection pool so the transactions begun through it
+// can buffer cache operations until commit
+type txPool struct {
+	gorm.ConnPool
+}
+
+// BeginTx begins a transaction on the wrapped pool
+func (p *txPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var (
+		tx  gorm.ConnPool
+		err error
+	)
+	switch beginner := p.ConnPool.(type) {
+	case gorm.TxBeginner:
+		tx, err = beginner.BeginTx(ctx, opts)
+	case gorm.ConnPoolBeginner:
+		tx, err = beginner.BeginTx(ctx, opts)
+	default:
+		err = gorm.ErrInvalidTransaction
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedTx{ConnPool: tx, pool: p}, nil
+}
+
+// GetDBConn returns the *sql.DB behind the wrapped pool
+func (p *txPool) GetDBConn() (*sql.DB, error) {
+	switch pool := p.ConnPool.(type) {
+	case *sql.DB:
+		return pool, nil
+	case gorm.GetDBConnector:
+		return pool.GetDBConn()
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+// bufferedTx is a transaction holding cache operations until it commits
+type bufferedTx struct {
+	gorm.ConnPool
+	pool *txPool
+
+	mu         sync.Mutex
+	ops        []func()
+	savepoints []savepoint
+}
+
+// savepoint is the number of operations buffered when a savepoint was set
+type savepoint struct {
+	name string
+	mark int
+}
+
+// buffer queues an operation to run after a successful commit
+func (t *bufferedTx) buffer(op func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops = append(t.ops, op)
+}
+
+// Commit commits the transaction and then runs the buffered operations
+func (t *bufferedTx) Commit() error {
+	if err := t.ConnPool.(gorm.TxCommitter).Commit(); err != nil {
+		t.drop()
+		return err
+	}
+	t.mu.Lock()
+	ops := t.ops
+	t.ops = nil
+	t.mu.Unlock()
+	for _, op := range ops {
+		op()
+	}
+	return nil
+}
+
+// Rollback rolls the transaction back and drops the buffered operations
+func (t *bufferedTx) Rollback() error {
+	t.drop()
+	return t.ConnPool.(gorm.TxCommitter).Rollback()
+}
+
+func (t *bufferedTx) drop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops = nil
+	t.savepoints = nil
+}
+
+// ExecContext runs a statement in the transaction, following the
+// savepoints it sets and rolls back to
+func (t *bufferedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := t.ConnPool.ExecContext(ctx, query, args...)
+	if err == nil {
+		t.track(query)
+	}
+	return result, err
+}
+
+// track records a savepoint set by query, or drops what was buffered
+// since the savepoint query rolls back to, as the statements SavePoint and
+// RollbackTo run on every dialect: "SAVEPOINT sp" and "ROLLBACK TO
+// SAVEPOINT sp", or "SAVE TRANSACTION sp" and "ROLLBACK TRANSACTION sp"
+func (t *bufferedTx) track(query string) {
+	words := strings.Fields(strings.ToUpper(query))
+	name := func(i int) string {
+		return strings.Trim(strings.Fields(query)[i], "`\"[]")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case len(words) == 2 && words[0] == "SAVEPOINT",
+		len(words) == 3 && words[0] == "SAVE" && (words[1] == "TRANSACTION" || words[1] == "TRAN"):
+		t.savepoints = append(t.savepoints, savepoint{name: name(len(words) - 1), mark: len(t.ops)})
+	case len(words) == 4 && words[0] == "ROLLBACK" && words[1] == "TO" && words[2] == "SAVEPOINT",
+		len(words) == 3 && words[0] == "ROLLBACK" && (words[1] == "TO" || words[1] == "TRANSACTION" || words[1] == "TRAN"):
+		target := name(len(words) - 1)
+		for i := len(t.savepoints) - 1; i >= 0; i-- {
+			if sp := t.savepoints[i]; sp.name == target {
+				t.ops = t.ops[:sp.mark]
+				t.savepoints = t.savepoints[:i+1] // the savepoint stays, later ones are gone
+				return
+			}
+		}
+	}
+}
+
+// StmtContext binds a prepared statement to the transaction
+func (t *bufferedTx) StmtContext(ctx context.Context, stmt *sql.Stmt) *sql.Stmt {
+	if tx, ok := t.ConnPool.(interface {
+		StmtContext(context.Context, *sql.Stmt) *sql.Stmt
+	}); ok {
+		return tx.StmtContext(ctx, stmt)
+	}
+	return stmt
+}
+
+// GetDBConn returns the *sql.DB the transaction was begun on
+func (t *bufferedTx) GetDBConn() (*sql.DB, error) {
+	return t.pool.GetDBConn()
+}
+
+// wrapTxPool installs txPool on db so its transactions buffer cache
+// operations
+func wrapTxPool(db *gorm.DB) {
+	if _, ok := db.ConnPool.(*txPool); ok {
+		return
+	}
+	pool := &txPool{ConnPool: db.ConnPool}
+	db.ConnPool = pool
+	db.Statement.ConnPool = pool
+}
+
+// txOf returns the transaction the statement runs in when it was begun
+// on the wrapped pool, whatever the policy
+func txOf(db *gorm.DB) *bufferedTx {
+	tx, _ := db.Statement.ConnPool.(*bufferedTx)
+	return tx
+}
+
+// bufferedTxOf returns the buffering transaction the statement runs in,
+// nil when the cache does not buffer for it
+func (g *GormCache) bufferedTxOf(db *gorm.DB) *bufferedTx {
+	if g.config.TxPolicy != TxBuffer {
+		return nil
+	}
+	return txOf(db)
+}
+
+// bufferSet snapshots the destination and queues its cache write until
+// the transaction commits, stored and tagged as setCache does
+func (g *GormCache) bufferSet(tx *bufferedTx, db *gorm.DB, key string) error {
+	if g.tooManyRows(key, db.RowsAffected) {
+		return nil
+	}
+	ttl := g.ttl(db)
+	data, err := g.payload(db, ttl)
+	if err != nil {
+		return err
+	}
+	if g.tooLarge(key, data) {
+		return nil
+	}
+	ctx, tags, sql := context.WithoutCancel(db.Statement.Context), entryTags(db), db.Statement.SQL.String()
+	tx.buffer(func() {
+		if err := g.store(ctx, key, data, tags, ttl); err != nil {
+			g.counters.errors.Add(1)
+			log.Printf("*** set buffered cache failed: %v", err)
+			return
+		}
+		if g.config.Adaptive {
+			g.latency.stored(sql, len(data))
+		}
+	})
+	return nil
+}
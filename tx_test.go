@@ -0,0 +1,159 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestTxBypass(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := newMockCacheClient()
+	require.NoError(t, db.Use(gormcache.NewGormCache("tx_cache", client, gormcache.CacheConfig{TTL: time.Minute})))
+
+	err := db.Session(&gorm.Session{Context: cacheCtx()}).Transaction(func(tx *gorm.DB) error {
+		var users []testUser
+		return tx.Find(&users).Error
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, client.gets)
+	assert.Equal(t, 0, client.sets)
+}
+
+func TestTxBuffer(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("tx_cache", client, gormcache.CacheConfig{
+		TTL:         time.Minute,
+		Generations: true,
+		TxPolicy:    gormcache.TxBuffer,
+	})
+	require.NoError(t, db.Use(cache))
+
+	find := func(db *gorm.DB) []testUser {
+		var users []testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Order("id").Find(&users).Error)
+		return users
+	}
+	assert.Len(t, find(db), 2)
+	sets := client.sets
+
+	// rollback drops the buffered invalidation and cache writes
+	err := db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Create(&testUser{ID: 3, Name: "user3"}).Error)
+		assert.Len(t, find(tx), 3, "reads inside the transaction skip the cache")
+		return errors.New("rollback")
+	})
+	require.Error(t, err)
+	assert.Equal(t, sets, client.sets)
+	assert.Len(t, find(db), 2)
+
+	// commit applies them
+	err = db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Create(&testUser{ID: 3, Name: "user3"}).Error)
+		assert.Len(t, find(tx), 3)
+		assert.Equal(t, sets, client.sets, "writes wait for the commit")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Greater(t, client.sets, sets)
+	assert.Len(t, find(db), 3)
+
+	// the wrapped pool still exposes the *sql.DB
+	_, err = db.DB()
+	assert.NoError(t, err)
+}
+
+func TestTxBufferSavepoints(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("tx_cache", client, gormcache.CacheConfig{
+		TTL:      time.Minute,
+		TxPolicy: gormcache.TxBuffer,
+	})
+	require.NoError(t, db.Use(cache))
+
+	find := func(db *gorm.DB) []testUser {
+		var users []testUser
+		require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Order("id").Find(&users).Error)
+		return users
+	}
+	assert.Len(t, find(db), 2)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// a nested transaction rolled back to its savepoint drops the
+		// reads it buffered
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			require.NoError(t, tx.Create(&testUser{ID: 3, Name: "user3"}).Error)
+			assert.Len(t, find(tx), 3)
+			return errors.New("rollback")
+		})
+		require.Error(t, err)
+
+		// and so does an explicit one
+		require.NoError(t, tx.SavePoint("before_user4").Error)
+		require.NoError(t, tx.Create(&testUser{ID: 4, Name: "user4"}).Error)
+		assert.Len(t, find(tx.Where("id > ?", 1)), 2)
+		require.NoError(t, tx.RollbackTo("before_user4").Error)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, find(db), 2)
+	assert.Len(t, find(db.Where("id > ?", 1)), 1)
+
+	// what a kept savepoint buffered is applied on commit
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			require.NoError(t, tx.Create(&testUser{ID: 3, Name: "user3"}).Error)
+			assert.Len(t, find(tx.Where("id > ?", 2)), 1)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	sets := client.sets
+	assert.Len(t, find(db.Where("id > ?", 2)), 1)
+	assert.Equal(t, sets, client.sets, "served from the entry the commit stored")
+}
+
+func TestTxBufferTags(t *testing.T) {
+	db := newTestDB(t, 2)
+	client := gormcache.NewMemoryClient()
+	cache := gormcache.NewGormCache("tx_cache", client, gormcache.CacheConfig{
+		TTL:      time.Minute,
+		TxPolicy: gormcache.TxBuffer,
+	})
+	require.NoError(t, db.Use(cache))
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Session(&gorm.Session{Context: cacheCtx()}).Find(&[]testUser{}).Error
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.Len())
+	assert.EqualValues(t, 1, cache.Stats().Sets)
+
+	// the committed entry is tagged, so purging its table drops it
+	require.NoError(t, cache.PurgeTable(context.Background(), "test_users"))
+	assert.Equal(t, 0, client.Len())
+}
@@ -19,16 +19,57 @@
 package gormcache
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"math/rand/v2"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-func (g *GormCache) cacheKey(db *gorm.DB) string {
-	sql := db.Dialector.Explain(db.Statement.SQL.String(), db.Statement.Vars...)
-	hash := sha256.Sum256([]byte(sql))
-	key := g.config.Prefix + hex.EncodeToString(hash[:])
+func (g *GormCache) cacheKey(db *gorm.DB) (string, error) {
+	sql, err := canonicalQuery(db)
+	if err != nil {
+		return "", err
+	}
+	if g.config.Generations {
+		ns, err := g.namespace(db.Statement.Context, queryTables(db))
+		if err != nil {
+			return "", err
+		}
+		sql += "\x00" + ns
+	}
+	if graph := graphOf(db); graph != nil {
+		sql += "\x00" + graph.preloads
+	}
+	if g.config.SchemaFingerprint {
+		sql += "\x00" + schemaFingerprint(db)
+	} else if dest := destinationType(db); dest != "" && (!g.config.Columns || isScalar(db.Statement.ReflectValue) || graphOf(db) != nil) {
+		// replayed columns fill any destination, JSON and compact
+		// scalars only their own type
+		sql += "\x00" + dest
+	}
+	key, err := g.keyGenerator().Key(db, sql)
+	if err != nil {
+		return "", err
+	}
 	//log.Printf("key: %v, sql: %v", key, sql)
-	return key
+	return g.config.Prefix + key, nil
+}
+
+// jitter randomizes ttl by up to TTLJitter or TTLJitterPercent either way,
+// whichever is larger. The spread is capped at half the TTL so the result
+// stays positive; a non-positive ttl means no expiration and is kept.
+func (g *GormCache) jitter(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return ttl
+	}
+	spread := max(g.config.TTLJitter, time.Duration(float64(ttl)*g.config.TTLJitterPercent/100))
+	spread = min(spread, ttl/2)
+	if spread <= 0 {
+		return ttl
+	}
+	random := g.config.Rand
+	if random == nil {
+		random = rand.Float64
+	}
+	return ttl + time.Duration((2*random()-1)*float64(spread))
 }
@@ -0,0 +1,123 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotInitialized is returned by operations that need the plugin to be
+// registered with db.Use first
+var ErrNotInitialized = errors.New("gormcache: plugin not initialized")
+
+// defaultWarmConcurrency is used when CacheConfig.WarmConcurrency is not set
+const defaultWarmConcurrency = 4
+
+// refreshKey marks a context whose queries must skip the cache lookup and
+// overwrite the entry
+type refreshKey struct{}
+
+// Warm runs the given query scopes with caching enabled and stores their
+// results, overwriting any existing entry. Each scope must execute a
+// finisher method such as Find or First, e.g.
+//
+//	func(db *gorm.DB) *gorm.DB { return db.Where("active = ?", true).Find(&[]User{}) }
+//
+// At most CacheConfig.WarmConcurrency scopes run at the same time. The
+// errors of failed scopes are joined together.
+func (g *GormCache) Warm(ctx context.Context, queries ...func(*gorm.DB) *gorm.DB) error {
+	if g.db == nil {
+		return ErrNotInitialized
+	}
+
+	limit := g.config.WarmConcurrency
+	if limit <= 0 {
+		limit = defaultWarmConcurrency
+	}
+	ctx = context.WithValue(context.WithValue(ctx, UseCacheKey, true), refreshKey{}, true)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, limit)
+	)
+	for _, query := range queries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+		wg.Add(1)
+		go func(query func(*gorm.DB) *gorm.DB) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := query(g.db.Session(&gorm.Session{NewDB: true, Context: ctx})).Error; err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(query)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// WarmEvery runs Warm right away and then every interval until ctx is
+// done. Choose an interval shorter than the TTL so hot entries are
+// refreshed before they expire. Errors are logged.
+func (g *GormCache) WarmEvery(ctx context.Context, interval time.Duration, queries ...func(*gorm.DB) *gorm.DB) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	g.WarmOn(ctx, ticker.C, queries...)
+}
+
+// WarmOn runs Warm right away and then on every value received from
+// ticks, until ctx is done or ticks is closed. It lets the schedule come
+// from elsewhere than a ticker, e.g. a cron library or a test. Errors are
+// logged.
+func (g *GormCache) WarmOn(ctx context.Context, ticks <-chan time.Time, queries ...func(*gorm.DB) *gorm.DB) {
+	for {
+		if err := g.Warm(ctx, queries...); err != nil && ctx.Err() == nil {
+			log.Printf("*** warm cache failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-ticks:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// refreshing reports whether the query must overwrite its cache entry
+// instead of reading it
+func refreshing(db *gorm.DB) bool {
+	refresh, _ := db.Statement.Context.Value(refreshKey{}).(bool)
+	return refresh
+}
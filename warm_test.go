@@ -0,0 +1,127 @@
+/*
+   Copyright 2023 Rodolfo González González
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gormcache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gormcache "github.com/rgglez/gormcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestWarmNotInitialized(t *testing.T) {
+	cache := gormcache.NewGormCache("warm_cache", newMockCacheClient(), gormcache.CacheConfig{})
+	assert.ErrorIs(t, cache.Warm(context.Background()), gormcache.ErrNotInitialized)
+}
+
+func TestWarm(t *testing.T) {
+	db := newTestDB(t, 5)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("warm_cache", client, gormcache.CacheConfig{
+		TTL:             time.Minute,
+		Prefix:          "warm:",
+		WarmConcurrency: 2,
+	})
+	require.NoError(t, db.Use(cache))
+
+	active := func(db *gorm.DB) *gorm.DB { return db.Where("id > ?", 2).Find(&[]testUser{}) }
+	first := func(db *gorm.DB) *gorm.DB { return db.Where("id = ?", 1).Find(&[]testUser{}) }
+	require.NoError(t, cache.Warm(context.Background(), active, first))
+	assert.Equal(t, 2, client.sets)
+
+	// warmed entries are hits, nothing is stored again
+	var users []testUser
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Where("id > ?", 2).Find(&users).Error)
+	assert.Len(t, users, 3)
+	assert.Equal(t, 2, client.sets)
+
+	// warming again overwrites the entries with fresh data
+	require.NoError(t, db.Exec("DELETE FROM test_users WHERE id = 5").Error)
+	require.NoError(t, cache.Warm(context.Background(), active))
+	require.NoError(t, db.Session(&gorm.Session{Context: cacheCtx()}).Where("id > ?", 2).Find(&users).Error)
+	assert.Len(t, users, 2)
+}
+
+func TestWarmJoinsErrors(t *testing.T) {
+	db := newTestDB(t, 1)
+	cache := gormcache.NewGormCache("warm_cache", newMockCacheClient(), gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	broken := func(db *gorm.DB) *gorm.DB { return db.Table("missing_table").Find(&[]testUser{}) }
+	ok := func(db *gorm.DB) *gorm.DB { return db.Find(&[]testUser{}) }
+	err := cache.Warm(context.Background(), broken, ok, broken)
+	require.Error(t, err)
+	assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), 2)
+}
+
+func TestWarmOn(t *testing.T) {
+	db := newTestDB(t, 1)
+	client := newMockCacheClient()
+	cache := gormcache.NewGormCache("warm_cache", client, gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	ran := make(chan struct{})
+	query := func(db *gorm.DB) *gorm.DB {
+		defer func() { ran <- struct{}{} }() // stored by then
+		return db.Find(&[]testUser{})
+	}
+	warm := func(ctx context.Context, ticks chan time.Time) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			cache.WarmOn(ctx, ticks, query)
+			close(done)
+		}()
+		return done
+	}
+
+	// right away, then once per tick until the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan time.Time)
+	done := warm(ctx, ticks)
+	<-ran
+	for i := 0; i < 2; i++ {
+		ticks <- time.Now()
+		<-ran
+	}
+	cancel()
+	<-done
+	assert.Equal(t, 3, client.sets)
+
+	// or until the ticks end
+	ticks = make(chan time.Time)
+	done = warm(context.Background(), ticks)
+	<-ran
+	close(ticks)
+	<-done
+	assert.Equal(t, 4, client.sets)
+}
+
+func TestWarmEveryStops(t *testing.T) {
+	db := newTestDB(t, 1)
+	cache := gormcache.NewGormCache("warm_cache", newMockCacheClient(), gormcache.CacheConfig{TTL: time.Minute})
+	require.NoError(t, db.Use(cache))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache.WarmEvery(ctx, time.Hour, func(db *gorm.DB) *gorm.DB { return db.Find(&[]testUser{}) })
+	assert.True(t, errors.Is(ctx.Err(), context.Canceled))
+}